@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/sqweek/sqribe/log"
+	"github.com/sqweek/sqribe/score"
+	"github.com/sqweek/sqribe/wave"
+
+	. "github.com/sqweek/sqribe/core/types"
+)
+
+/* detectBeats replaces the beats within 'rng' with ones found by onset detection and
+ * tempo tracking. If 'rng' is a BeatRange its beats seed the tempo estimate. */
+func detectBeats(rng TimeRange) {
+	wav := G.wav
+	if wav == nil {
+		return
+	}
+	min, max := rng.MinFrame(), rng.MaxFrame()
+	var prior FrameN
+	if br, ok := rng.(score.BeatRange); ok {
+		min, max = br.First.Frame(), br.Last.Frame()
+		if nb := br.Last.Subtract(br.First); nb > 0 {
+			prior = (max - min) / FrameN(nb)
+		}
+		max-- // the range stops short of its Last beat, which is kept
+	}
+	if min >= max {
+		whole := wave.Range(wav)
+		min, max = whole.MinFrame(), whole.MaxFrame()
+	}
+	start := time.Now()
+	env := wav.OnsetEnvelope(min, max)
+	beats := env.TrackBeats(prior)
+	log.UI.Printf("detected %d beats in %v", len(beats), time.Now().Sub(start))
+	if len(beats) == 0 {
+		return
+	}
+	if err := G.score.ReplaceBeats(min, max, beats); err != nil {
+		alert("beat detection: %v", err)
+	}
+}
+
+/* beatWindow returns how far either side of 'frame' a tapped beat may be from where
+ * it belongs: an eighth of the local beat period (at most 1/8th of a second), or
+ * 1/16th of a second if the tempo isn't known yet. */
+func beatWindow(wav *wave.Waveform, frame FrameN) FrameN {
+	window := FrameN(wav.Rate() / 16)
+	if period := G.score.Period(frame); period > 0 {
+		window = period / 8
+	}
+	if max := FrameN(wav.Rate() / 8); window > max {
+		window = max
+	}
+	return window
+}
+
+/* tapBeat adds a beat at the strongest onset near 'frame' */
+func tapBeat(frame FrameN) {
+	wav := G.wav
+	if wav == nil {
+		return
+	}
+	window := beatWindow(wav, frame)
+	G.score.AddBeat(wav.NearestOnset(frame, window), window)
+}
+
+/* snapBeats moves each beat in 'rng' to the strongest onset near it. A beat never moves
+ * past the new position of the beat before it, nor the old position of the beat after
+ * it, so the beats stay in order. */
+func snapBeats(rng score.BeatRange) {
+	wav := G.wav
+	if wav == nil {
+		return
+	}
+	moves := make(map[*score.BeatRef]FrameN)
+	prev := FrameN(-1)
+	if p := rng.First.Prev(); p != nil {
+		prev = p.Frame()
+	}
+	for b := rng.First; b != nil && b != rng.Last; b = b.Next() {
+		f := wav.NearestOnset(b.Frame(), beatWindow(wav, b.Frame()))
+		if f <= prev {
+			f = prev + 1
+		}
+		if next := b.Next(); next != nil && f >= next.Frame() {
+			f = next.Frame() - 1
+		}
+		moves[b] = f
+		prev = f
+	}
+	G.score.MvBeats(moves)
+}
+
+/* snapNotes nudges each of 'notes' to play at the nearest onset in the audio, leaving the
+ * written rhythm alone. With 'clear' the nudges are removed instead. */
+func snapNotes(notes []score.StaffNote, clear bool) {
+	wav := G.wav
+	if len(notes) == 0 || (wav == nil && !clear) {
+		return
+	}
+	nudges := make([]FrameN, len(notes))
+	if !clear {
+		for i, sn := range notes {
+			f, ok := G.score.ToFrame(sn.Staff.SoundingBeatf(sn.Note))
+			if !ok {
+				nudges[i] = sn.Note.Nudge
+				continue
+			}
+			nudges[i] = wav.NearestOnset(f, beatWindow(wav, f)) - f
+		}
+	}
+	G.score.Nudge(nudges, notes...)
+}
+
+/* suggestNotes proposes notes for 'staff' within 'rng' by detecting the pitches sounding
+ * between successive onsets, quantized to the note grid. The suggestions are shown as
+ * ghost notes until accepted or rejected. */
+func suggestNotes(rng score.BeatRange, staff *score.Staff) {
+	wav, sc := G.wav, G.score
+	if wav == nil || staff == nil || rng.First == rng.Last {
+		return
+	}
+	type position struct {
+		beat *score.BeatRef
+		offset *big.Rat
+	}
+	start := time.Now()
+	min, max := rng.First.Frame(), rng.Last.Frame()
+	context := FrameN(wav.Rate()) // normalise against a second either side
+	env := wav.OnsetEnvelope(min - context, max + context)
+	positions := []position{{rng.First, new(big.Rat)}}
+	for _, f := range env.Peaks(1.5, FrameN(wav.Rate() / 20)) {
+		pt, ok := sc.ToBeat(f)
+		if f <= min || f >= max || !ok {
+			continue
+		}
+		beat, offset := sc.QuantizeOn(staff, staff.Unswing(pt))
+		prev := positions[len(positions) - 1]
+		if Δb(beat, offset, prev.beat, prev.offset).Sign() > 0 && Δb(rng.Last, &rZero, beat, offset).Sign() > 0 {
+			positions = append(positions, position{beat, offset})
+		}
+	}
+	positions = append(positions, position{rng.Last, new(big.Rat)})
+
+	lo, hi := staff.PitchForLine(rng.First, -10), staff.PitchForLine(rng.First, 10) // up to three ledger lines
+	attack := FrameN(wav.Rate() / 20) // skip the onset transient
+	notes := make([]*score.Note, 0)
+	for i := 0; i + 1 < len(positions); i++ {
+		p, q := positions[i], positions[i+1]
+		f0, fN := p.beat.FrameAtRat(p.offset), q.beat.FrameAtRat(q.offset)
+		if fN - f0 > 2 * attack {
+			f0 += attack
+		}
+		for _, pitch := range wav.DetectPitches(f0, fN, lo, hi) {
+			notes = append(notes, &score.Note{
+				Pitch: pitch,
+				Duration: Δb(q.beat, q.offset, p.beat, p.offset),
+				Beat: p.beat,
+				Offset: new(big.Rat).Set(p.offset),
+			})
+		}
+	}
+	log.UI.Printf("suggested %d notes in %v", len(notes), time.Now().Sub(start))
+	G.ww.Suggest(staff, notes)
+}
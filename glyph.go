@@ -4,6 +4,8 @@ import (
 	"image/color"
 	"image"
 	"math"
+
+	"github.com/sqweek/sqribe/score"
 )
 
 type CenteredGlyph struct {
@@ -46,6 +48,35 @@ func newHollowNote(col color.NRGBA, p image.Point, r int, α float64) *NoteHead
 	return &NoteHead{CenteredGlyph{col, p, r}, α, 0.6}
 }
 
+/* XHead is the cross-shaped note head used for cymbals on a percussion staff. Notes of a
+ * half or longer are circled. */
+type XHead struct {
+	CenteredGlyph
+	circled bool
+}
+
+func (n *XHead) At(x, y int) color.Color {
+	dx, dy := x - n.p.X, y - n.p.Y
+	if dx >= -n.r && dx <= n.r && (dx == dy || dx == -dy) {
+		return n.col
+	}
+	if n.circled {
+		d := math.Hypot(float64(dx), float64(dy))
+		if d > float64(n.r) + 0.5 && d <= float64(n.r) + 1.5 {
+			return n.col
+		}
+	}
+	return color.NRGBA{0, 0, 0, 0}
+}
+
+func (n *XHead) Bounds() image.Rectangle {
+	return n.CenteredGlyph.Bounds().Inset(-2)
+}
+
+func newXHead(col color.NRGBA, p image.Point, r int, circled bool) *XHead {
+	return &XHead{CenteredGlyph{col, p, r}, circled}
+}
+
 type NoteTail struct {
 	CenteredGlyph
 	downBeam bool
@@ -218,3 +249,161 @@ var IconWave *image.Alpha = MkIcon([]string{
 "____##__________",
 "____#___________",
 })
+
+/* RestGlyph is a crotchet rest, or with 'flags' a quaver/semiquaver/etc. rest */
+type RestGlyph struct {
+	CenteredGlyph
+	flags int
+}
+
+func (g *RestGlyph) At(x, y int) color.Color {
+	dx, dy := x - g.p.X, y - g.p.Y
+	if g.flags == 0 {
+		/* a zigzag down the centre */
+		var target int
+		if dy < 0 {
+			target = (dy + g.r) / 2 - g.r / 4
+		} else {
+			target = g.r / 4 - dy / 2
+		}
+		if dx - target >= -1 && dx - target <= 1 {
+			return g.col
+		}
+		return color.NRGBA{0, 0, 0, 0}
+	}
+	/* a slanted stem, with a blob and hook for each flag */
+	if dx * 3 == -dy + 1 && dy > -g.r {
+		return g.col
+	}
+	for i := 0; i < g.flags; i++ {
+		fy := -g.r + 2 + i * 4
+		if (dy == fy && dx <= 0 && dx > -g.r / 2 - 1) ||
+		    (dy == fy - 1 && dx <= -g.r / 2 + 1 && dx > -g.r / 2 - 2) {
+			return g.col
+		}
+	}
+	return color.NRGBA{0, 0, 0, 0}
+}
+
+/* TieGlyph is a shallow arc from 'p' to 'x1', curving down (or up if 'above') */
+type TieGlyph struct {
+	col color.NRGBA
+	p image.Point
+	x1 int
+	above bool
+}
+
+func (t *TieGlyph) ColorModel() color.Model {
+	return color.NRGBAModel
+}
+
+func (t *TieGlyph) Bounds() image.Rectangle {
+	return image.Rect(t.p.X, t.p.Y - 5, t.x1 + 1, t.p.Y + 6)
+}
+
+func (t *TieGlyph) At(x, y int) color.Color {
+	if t.x1 <= t.p.X {
+		return color.NRGBA{0, 0, 0, 0}
+	}
+	α := float64(x - t.p.X) / float64(t.x1 - t.p.X)
+	h := 4.0 * α * (1 - α) * 4.0
+	if t.above {
+		h = -h
+	}
+	if math.Abs(float64(y - t.p.Y) - h) < 0.75 {
+		return t.col
+	}
+	return color.NRGBA{0, 0, 0, 0}
+}
+
+/* BraceGlyph is a curly brace with its right edge at x, spanning top to bottom and
+ * pointing left by 'w' at its middle */
+type BraceGlyph struct {
+	col color.NRGBA
+	x, top, bottom int
+	w int
+}
+
+func (b *BraceGlyph) ColorModel() color.Model {
+	return color.NRGBAModel
+}
+
+func (b *BraceGlyph) Bounds() image.Rectangle {
+	return image.Rect(b.x - b.w - 1, b.top, b.x + 1, b.bottom + 1)
+}
+
+func (b *BraceGlyph) At(x, y int) color.Color {
+	h := float64(b.bottom - b.top)
+	if h <= 0 {
+		return color.NRGBA{0, 0, 0, 0}
+	}
+	u := math.Abs(2 * float64(y - b.top) / h - 1) // 1 at the tips, 0 in the middle
+	/* each arm bows to the left, then kinks to a point at the middle */
+	cx := float64(b.x) - float64(b.w) * (math.Pow(1 - u, 4) + 0.3 * math.Sin(math.Pi * u))
+	thick := 0.5 + 0.8 * math.Sin(math.Pi * u)
+	if math.Abs(float64(x) - cx) <= thick {
+		return b.col
+	}
+	return color.NRGBA{0, 0, 0, 0}
+}
+
+/* HairpinGlyph is a crescendo (or, if not 'opening', diminuendo) wedge from x0 to x1,
+ * centred on y and 'h' pixels tall at its open end */
+type HairpinGlyph struct {
+	col color.NRGBA
+	x0, x1, y int
+	h int
+	opening bool
+}
+
+func (g *HairpinGlyph) ColorModel() color.Model {
+	return color.NRGBAModel
+}
+
+func (g *HairpinGlyph) Bounds() image.Rectangle {
+	return image.Rect(g.x0, g.y - g.h / 2 - 1, g.x1 + 1, g.y + g.h / 2 + 2)
+}
+
+func (g *HairpinGlyph) At(x, y int) color.Color {
+	if g.x1 <= g.x0 || x < g.x0 || x > g.x1 {
+		return color.NRGBA{0, 0, 0, 0}
+	}
+	α := float64(x - g.x0) / float64(g.x1 - g.x0)
+	if !g.opening {
+		α = 1 - α
+	}
+	spread := α * float64(g.h) / 2
+	dy := math.Abs(float64(y - g.y))
+	if math.Abs(dy - spread) < 0.75 {
+		return g.col
+	}
+	return color.NRGBA{0, 0, 0, 0}
+}
+
+/* ArticGlyph is an articulation mark: a staccato dot, an accent, a tenuto line, or a
+ * fermata (drawn opening downwards, as above the staff) */
+type ArticGlyph struct {
+	CenteredGlyph
+	kind score.Articulation
+}
+
+func (g *ArticGlyph) At(x, y int) color.Color {
+	dx, dy := x - g.p.X, y - g.p.Y
+	in := false
+	switch g.kind {
+	case score.Staccato:
+		in = dx >= -1 && dx <= 0 && dy >= -1 && dy <= 0
+	case score.Accent:
+		/* a '>' twice as wide as it is tall */
+		in = dx >= -g.r && dx <= g.r && (g.r - dx) / 2 == abs(dy)
+	case score.Tenuto:
+		in = dy == 0 && dx >= -g.r && dx <= g.r
+	case score.Fermata:
+		d := math.Hypot(float64(dx), float64(dy) + 0.5)
+		in = (dy <= 0 && d > float64(g.r) - 0.5 && d <= float64(g.r) + 0.5) || (dx >= -1 && dx <= 0 && dy >= -2 && dy <= -1)
+	}
+	if in {
+		return g.col
+	}
+	return color.NRGBA{0, 0, 0, 0}
+}
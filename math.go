@@ -30,6 +30,13 @@ func mod(n, d int) int {
 	return r
 }
 
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
 func ceil(n, d int) int {
 	q, r := n / d, n % d
 	if r == 0 {
@@ -22,6 +22,7 @@ const (
 	InstHarp = 46
 	InstVoice = 53
 	InstWoodblock = 115
+	InstDrums = 128 // not a program; the kit on the percussion channel
 )
 
 var degreeNames []string = []string{"C", "Db", "D", "Eb", "E", "F", "Gb", "G", "Ab", "A", "Bb", "B"}
@@ -92,6 +93,7 @@ func init() {
 	inst(InstHarp, "Harp")
 	inst(InstVoice, "Voice")
 	inst(InstWoodblock, "Woodblock")
+	inst(InstDrums, "Drums")
 }
 
 func InstName(id int) string {
@@ -1,7 +1,9 @@
 package midi
 
 import (
+	"bytes"
 	"testing"
+	"time"
 )
 
 func TestPitchNames(t *testing.T) {
@@ -62,3 +64,71 @@ func TestFailures(t *testing.T) {
 	pitchMustFail(t, "")
 	pitchMustFail(t, "♭A5")
 }
+
+func TestSMFRoundTrip(t *testing.T) {
+	var conductor, notes Track
+	conductor.Meta(0, MetaTempo, 0x07, 0xa1, 0x20) // 500000µs per quarter
+	conductor.Meta(960, MetaTempo, 0x03, 0xd0, 0x90) // 250000µs
+	conductor.Meta(0, MetaTimeSig, 3, 2, 24, 8)
+	notes.Add(0, ProgramChange(1, InstViolin)...)
+	notes.Add(480, NoteOff(1, PitchC5)...)
+	notes.Add(0, NoteOn(1, PitchC5, 100)...)
+	notes.Add(480, NoteOn(1, PitchC5, 90)...)
+	notes.Add(100000, NoteOff(1, PitchC5)...) // needs a multi-byte delta
+	smf := SMF{Format: 1, Division: 480, Tracks: []*Track{&conductor, &notes}}
+	var buf bytes.Buffer
+	if err := smf.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	smf2, err := ReadSMF(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if smf2.Format != 1 || smf2.Division != 480 || len(smf2.Tracks) != 2 {
+		t.Fatalf("header mismatch: %+v", smf2)
+	}
+	evs := smf2.Tracks[1].Events
+	if len(evs) != 6 || !evs[5].IsMeta() {
+		t.Fatalf("expected 5 events and end of track, got %v", evs)
+	}
+	/* at tick 480 the note off must precede the repeated note on */
+	if evs[1].Tick != 0 || !evs[1].IsNoteOn() || evs[2].Tick != 480 || !evs[2].IsNoteOff() || !evs[3].IsNoteOn() {
+		t.Fatalf("events out of order: %v", evs)
+	}
+	if evs[4].Tick != 100000 || evs[4].Channel() != 1 {
+		t.Fatalf("bad final event: %v", evs[4])
+	}
+	sigs := smf2.TimeSigs()
+	if len(sigs) != 1 || sigs[0].Beats != 3 || sigs[0].Unit != 4 {
+		t.Fatalf("bad time signatures: %v", sigs)
+	}
+	tm := smf2.TempoMap()
+	if d := tm.Time(1440); d != 1250 * time.Millisecond {
+		t.Fatalf("tick 1440 should be at 1.25s, got %v", d)
+	}
+}
+
+func TestBadHeaders(t *testing.T) {
+	for _, hdr := range []string{
+		"MThd\x00\x00\x00\x06\x00\x00\x00\x01\x00\x00", // zero division
+		"MThd\x00\x00\x00\x20\x00\x00\x00\x01\x00\x60", // header runs past the end
+		"MThd\x00\x00\x00\x02\x00\x00\x00\x01\x00\x60", // header too short
+	} {
+		if _, err := ReadSMF(bytes.NewReader([]byte(hdr))); err == nil {
+			t.Errorf("expected an error reading %q", hdr)
+		}
+	}
+}
+
+func TestRunningStatus(t *testing.T) {
+	trk := []byte{0, 0x90, 60, 100, 10, 62, 100, 10, 60, 0, 0, 0xff, MetaEndOfTrack, 0}
+	data := append([]byte("MThd\x00\x00\x00\x06\x00\x00\x00\x01\x00\x60MTrk\x00\x00\x00"), byte(len(trk)))
+	smf, err := ReadSMF(bytes.NewReader(append(data, trk...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	evs := smf.Tracks[0].Events
+	if len(evs) != 4 || !evs[1].IsNoteOn() || evs[1].Data[1] != 62 || !evs[2].IsNoteOff() || evs[2].Tick != 20 {
+		t.Fatalf("running status not expanded: %v", evs)
+	}
+}
@@ -0,0 +1,368 @@
+package midi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+const (
+	MetaText = 0x01
+	MetaTrackName = 0x03
+	MetaEndOfTrack = 0x2f
+	MetaTempo = 0x51
+	MetaTimeSig = 0x58
+	MetaKeySig = 0x59
+
+	ChanDrums = 9 // general midi percussion channel
+)
+
+/* Event is a timed event within a Standard MIDI File track. Data holds the raw bytes
+ * following the delta time, starting with the status byte (0xff for meta events). */
+type Event struct {
+	Tick int
+	Data []byte
+}
+
+func (ev Event) IsMeta() bool {
+	return len(ev.Data) > 0 && ev.Data[0] == 0xff
+}
+
+func (ev Event) IsNoteOn() bool {
+	return ev.Data[0] & 0xf0 == 0x90 && len(ev.Data) > 2 && ev.Data[2] > 0
+}
+
+func (ev Event) IsNoteOff() bool {
+	status := ev.Data[0] & 0xf0
+	return status == 0x80 || (status == 0x90 && len(ev.Data) > 2 && ev.Data[2] == 0)
+}
+
+/* returns the status nibble (eg. 0x90 for note on) of a channel event, or 0 */
+func (ev Event) Status() byte {
+	if ev.Data[0] >= 0xf0 {
+		return 0
+	}
+	return ev.Data[0] & 0xf0
+}
+
+func (ev Event) Channel() uint8 {
+	return ev.Data[0] & 0x0f
+}
+
+/* returns the type and payload of a meta event */
+func (ev Event) Meta() (byte, []byte) {
+	if !ev.IsMeta() || len(ev.Data) < 2 {
+		return 0, nil
+	}
+	n, i := readVlq(ev.Data[2:])
+	if 2 + i + n > len(ev.Data) {
+		return ev.Data[1], nil
+	}
+	return ev.Data[1], ev.Data[2+i:2+i+n]
+}
+
+/* priority orders events sharing a tick: meta events first, then note offs so that
+ * a repeated note isn't cut short by its predecessor */
+func (ev Event) priority() int {
+	switch {
+	case ev.IsMeta(): return 0
+	case ev.IsNoteOff(): return 1
+	}
+	return 2
+}
+
+type Track struct {
+	Events []Event
+}
+
+func (t *Track) Add(tick int, data... byte) {
+	t.Events = append(t.Events, Event{tick, data})
+}
+
+func (t *Track) Meta(tick int, typ byte, data... byte) {
+	ev := append([]byte{0xff, typ}, vlq(len(data))...)
+	t.Add(tick, append(ev, data...)...)
+}
+
+func (t *Track) Len() int {
+	return len(t.Events)
+}
+
+func (t *Track) Less(i, j int) bool {
+	a, b := t.Events[i], t.Events[j]
+	return a.Tick < b.Tick || (a.Tick == b.Tick && a.priority() < b.priority())
+}
+
+func (t *Track) Swap(i, j int) {
+	t.Events[i], t.Events[j] = t.Events[j], t.Events[i]
+}
+
+/* SMF is a Standard MIDI File. Division is the number of ticks per quarter note. */
+type SMF struct {
+	Format int
+	Division int
+	Tracks []*Track
+}
+
+func NoteOn(ch, pitch, velocity uint8) []byte {
+	return []byte{0x90 | ch, pitch, velocity}
+}
+
+func NoteOff(ch, pitch uint8) []byte {
+	return []byte{0x80 | ch, pitch, 0}
+}
+
+func ProgramChange(ch, program uint8) []byte {
+	return []byte{0xc0 | ch, program}
+}
+
+func ControlChange(ch, ctl, value uint8) []byte {
+	return []byte{0xb0 | ch, ctl, value}
+}
+
+/* PitchBend takes a value from -8192 to 8191 */
+func PitchBend(ch uint8, value int) []byte {
+	value += 8192
+	return []byte{0xe0 | ch, byte(value & 0x7f), byte((value >> 7) & 0x7f)}
+}
+
+func vlq(n int) []byte {
+	b := []byte{byte(n & 0x7f)}
+	for n >>= 7; n > 0; n >>= 7 {
+		b = append([]byte{byte(n & 0x7f) | 0x80}, b...)
+	}
+	return b
+}
+
+/* Write encodes the file. Each track's events are sorted, and terminated with an
+ * end-of-track event if they aren't already. */
+func (smf *SMF) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("MThd")
+	binary.Write(bw, binary.BigEndian, []uint32{6})
+	binary.Write(bw, binary.BigEndian, []uint16{uint16(smf.Format), uint16(len(smf.Tracks)), uint16(smf.Division)})
+	for _, t := range smf.Tracks {
+		sort.Stable(t)
+		data := make([]byte, 0, 8 * len(t.Events))
+		tick := 0
+		for _, ev := range t.Events {
+			data = append(data, vlq(ev.Tick - tick)...)
+			data = append(data, ev.Data...)
+			tick = ev.Tick
+		}
+		if n := len(t.Events); n == 0 || !isEndOfTrack(t.Events[n-1]) {
+			data = append(data, 0, 0xff, MetaEndOfTrack, 0)
+		}
+		bw.WriteString("MTrk")
+		binary.Write(bw, binary.BigEndian, uint32(len(data)))
+		bw.Write(data)
+	}
+	return bw.Flush()
+}
+
+func isEndOfTrack(ev Event) bool {
+	return ev.IsMeta() && len(ev.Data) > 1 && ev.Data[1] == MetaEndOfTrack
+}
+
+func readVlq(b []byte) (n, size int) {
+	for i, c := range b {
+		n = n << 7 | int(c & 0x7f)
+		if c & 0x80 == 0 || i == 3 {
+			return n, i + 1
+		}
+	}
+	return n, len(b)
+}
+
+type SMFError struct {
+	msg string
+}
+
+func (e SMFError) Error() string {
+	return "invalid midi file: " + e.msg
+}
+
+/* ReadSMF decodes a Standard MIDI File. Running status is expanded, so every channel
+ * event's Data starts with its status byte. */
+func ReadSMF(r io.Reader) (*SMF, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 14 || string(data[0:4]) != "MThd" {
+		return nil, SMFError{"no header"}
+	}
+	hlen := int(binary.BigEndian.Uint32(data[4:8]))
+	if hlen < 6 || 8 + hlen > len(data) {
+		return nil, SMFError{"bad header length"}
+	}
+	smf := SMF{
+		Format: int(binary.BigEndian.Uint16(data[8:10])),
+		Division: int(binary.BigEndian.Uint16(data[12:14])),
+	}
+	if smf.Division & 0x8000 != 0 {
+		return nil, SMFError{"SMPTE time division is not supported"}
+	} else if smf.Division == 0 {
+		return nil, SMFError{"zero ticks per quarter note"}
+	}
+	for chunk := data[8 + hlen:]; len(chunk) >= 8; {
+		clen := int(binary.BigEndian.Uint32(chunk[4:8]))
+		if 8 + clen > len(chunk) {
+			return nil, SMFError{"truncated chunk"}
+		}
+		if string(chunk[0:4]) == "MTrk" {
+			track, err := readTrack(chunk[8:8+clen])
+			if err != nil {
+				return nil, err
+			}
+			smf.Tracks = append(smf.Tracks, track)
+		}
+		chunk = chunk[8+clen:]
+	}
+	return &smf, nil
+}
+
+func readTrack(b []byte) (*Track, error) {
+	track := &Track{}
+	tick := 0
+	var running byte
+	for len(b) > 0 {
+		Δ, n := readVlq(b)
+		tick += Δ
+		b = b[n:]
+		if len(b) == 0 {
+			return nil, SMFError{"truncated event"}
+		}
+		status := b[0]
+		var size int
+		switch {
+		case status == 0xff:
+			if len(b) < 2 {
+				return nil, SMFError{"truncated meta event"}
+			}
+			l, n := readVlq(b[2:])
+			size = 2 + n + l
+		case status == 0xf0 || status == 0xf7:
+			l, n := readVlq(b[1:])
+			size = 1 + n + l
+		case status & 0x80 == 0:
+			/* running status; reuse the previous status byte */
+			if running == 0 {
+				return nil, SMFError{"data byte without status"}
+			}
+			size = channelEventSize(running) - 1
+			if size > len(b) {
+				return nil, SMFError{"truncated event"}
+			}
+			track.Add(tick, append([]byte{running}, b[:size]...)...)
+			b = b[size:]
+			continue
+		default:
+			running = status
+			size = channelEventSize(status)
+		}
+		if size > len(b) {
+			return nil, SMFError{fmt.Sprintf("truncated event at tick %d", tick)}
+		}
+		track.Add(tick, append([]byte(nil), b[:size]...)...)
+		b = b[size:]
+	}
+	return track, nil
+}
+
+func channelEventSize(status byte) int {
+	switch status & 0xf0 {
+	case 0xc0, 0xd0:
+		return 2
+	}
+	return 3
+}
+
+/* Name returns the first track name found in the track, if any */
+func (t *Track) Name() string {
+	for _, ev := range t.Events {
+		if typ, data := ev.Meta(); typ == MetaTrackName {
+			return string(data)
+		}
+	}
+	return ""
+}
+
+type TimeSigEvent struct {
+	Tick int
+	Beats, Unit int
+}
+
+/* maxTimeSigUnit is the largest power of two accepted as a time signature's denominator */
+const maxTimeSigUnit = 6 // 64th notes
+
+/* TimeSigs returns the time signature changes from every track, in order. Those with a
+ * denominator shorter than a 64th note are ignored. */
+func (smf *SMF) TimeSigs() []TimeSigEvent {
+	sigs := make([]TimeSigEvent, 0)
+	for _, t := range smf.Tracks {
+		for _, ev := range t.Events {
+			if typ, data := ev.Meta(); typ == MetaTimeSig && len(data) >= 2 && data[1] <= maxTimeSigUnit {
+				sigs = append(sigs, TimeSigEvent{ev.Tick, int(data[0]), 1 << data[1]})
+			}
+		}
+	}
+	sort.Sort(timeSigsByTick(sigs))
+	return sigs
+}
+
+type timeSigsByTick []TimeSigEvent
+
+func (s timeSigsByTick) Len() int { return len(s) }
+func (s timeSigsByTick) Less(i, j int) bool { return s[i].Tick < s[j].Tick }
+func (s timeSigsByTick) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+/* TempoMap converts ticks to time according to the file's tempo changes */
+type TempoMap struct {
+	division int
+	ticks []int
+	µsPerQuarter []int
+}
+
+func (smf *SMF) TempoMap() *TempoMap {
+	tm := TempoMap{division: smf.Division, ticks: []int{0}, µsPerQuarter: []int{500000}}
+	var tempos Track
+	for _, t := range smf.Tracks {
+		for _, ev := range t.Events {
+			if typ, data := ev.Meta(); typ == MetaTempo && len(data) == 3 {
+				tempos.Events = append(tempos.Events, ev)
+			}
+		}
+	}
+	sort.Stable(&tempos)
+	for _, ev := range tempos.Events {
+		_, data := ev.Meta()
+		µs := int(data[0]) << 16 | int(data[1]) << 8 | int(data[2])
+		if ev.Tick == tm.ticks[len(tm.ticks) - 1] {
+			tm.µsPerQuarter[len(tm.ticks) - 1] = µs
+		} else {
+			tm.ticks = append(tm.ticks, ev.Tick)
+			tm.µsPerQuarter = append(tm.µsPerQuarter, µs)
+		}
+	}
+	return &tm
+}
+
+func (tm *TempoMap) Time(tick int) time.Duration {
+	µs := 0.0
+	for i, t0 := range tm.ticks {
+		t1 := tick
+		if i + 1 < len(tm.ticks) && tm.ticks[i+1] < tick {
+			t1 = tm.ticks[i+1]
+		}
+		if t1 <= t0 {
+			break
+		}
+		µs += float64(t1 - t0) * float64(tm.µsPerQuarter[i]) / float64(tm.division)
+	}
+	return time.Duration(µs * float64(time.Microsecond))
+}
@@ -45,7 +45,16 @@ func (m *MixConfig) LoadStaff(staff *score.Staff, saved SavedStaff) {
 	stm.Muted = saved.Muted
 }
 
+/* lead returns the staff whose mix is shared by the rest of its part */
+func (m *MixConfig) lead(staff *score.Staff) *score.Staff {
+	if G.score == nil {
+		return staff
+	}
+	return G.score.PartOf(staff)[0]
+}
+
 func (m *MixConfig) For(staff *score.Staff) *StaffMix {
+	staff = m.lead(staff)
 	if sm, ok := m.Staff[staff]; ok {
 		return sm
 	}
@@ -53,12 +62,22 @@ func (m *MixConfig) For(staff *score.Staff) *StaffMix {
 	return m.Staff[staff]
 }
 
+/* Inst returns the instrument 'staff' is played with; a percussion staff always plays the
+ * drum kit */
+func (m *MixConfig) Inst(staff *score.Staff) int {
+	if staff.Clef().IsPercussion() {
+		return midi.InstDrums
+	}
+	return m.For(staff).Voice
+}
+
 func (m *MixConfig) IsSolo(s *score.Staff) bool {
+	s = m.lead(s)
 	if m.For(s).Muted {
 		return false
 	}
 	for staff, mix := range m.Staff {
-		if staff != s && !mix.Muted {
+		if staff != s && m.lead(staff) == staff && !mix.Muted {
 			return false
 		}
 	}
@@ -66,6 +85,7 @@ func (m *MixConfig) IsSolo(s *score.Staff) bool {
 }
 
 func (m *MixConfig) ToggleSolo(s *score.Staff) {
+	s = m.lead(s)
 	if m.IsSolo(s) {
 		for staff, mix := range m.Staff {
 			old := false
@@ -6,12 +6,14 @@ import (
 	"io"
 	"math/big"
 	"os"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/sqweek/sqribe/midi"
 	"github.com/sqweek/sqribe/score"
+
+	. "github.com/sqweek/sqribe/core/types"
 )
 
 type XMLWriter struct {
@@ -85,26 +87,81 @@ func mxmlIdent(wr *XMLWriter) {
 }
 
 func mxmlParts(wr *XMLWriter) {
-	staves := G.score.Staves()
+	parts := G.score.Parts()
 	list := wr.Tag("part-list")
-	for i, staff := range staves {
-		mix := Mixer.For(staff)
-		instName := midi.InstName(mix.Voice)
+	for i, part := range parts {
+		instName := midi.InstName(Mixer.Inst(part[0]))
 		id := fmt.Sprintf("P%d", i)
 		xpart := wr.Tag("score-part", "id", id)
 		wr.ContentTag("part-name", instName)
-		xinst := wr.Tag("score-instrument", "id", fmt.Sprintf("%s-I1", id))
-		wr.ContentTag("instrument-name", instName)
-		wr.CloseTag(xinst)
+		drums := mxmlDrums(part)
+		if len(drums) == 0 || !part[0].Clef().IsPercussion() {
+			xinst := wr.Tag("score-instrument", "id", mxmlInstId(id, 0))
+			wr.ContentTag("instrument-name", instName)
+			wr.CloseTag(xinst)
+		}
+		/* each drum of the kit is an instrument of its own */
+		for _, d := range drums {
+			xinst := wr.Tag("score-instrument", "id", mxmlInstId(id, d.Key))
+			wr.ContentTag("instrument-name", d.Name)
+			wr.CloseTag(xinst)
+		}
+		for _, d := range drums {
+			xmidi := wr.Tag("midi-instrument", "id", mxmlInstId(id, d.Key))
+			wr.ContentTag("midi-channel", midi.ChanDrums + 1)
+			wr.ContentTag("midi-unpitched", d.Key + 1)
+			wr.CloseTag(xmidi)
+		}
 		wr.CloseTag(xpart)
 	}
 	wr.CloseTag(list)
-	for i, staff := range staves {
+	for i, part := range parts {
 		id := fmt.Sprintf("P%d", i)
-		mxmlPart(wr, staff, id)
+		mxmlPart(wr, part, id)
 	}
 }
 
+/* mxmlInstId names the instrument of a part which plays 'drum', or the part's only
+ * instrument if 'drum' is 0 */
+func mxmlInstId(part string, drum uint8) string {
+	if drum == 0 {
+		return fmt.Sprintf("%s-I1", part)
+	}
+	return fmt.Sprintf("%s-D%d", part, drum)
+}
+
+/* mxmlDrums lists the sounds played on the percussion staves of a part, in kit order */
+func mxmlDrums(part []*score.Staff) []score.DrumSound {
+	used := make(map[uint8]bool)
+	for _, staff := range part {
+		if !staff.Clef().IsPercussion() {
+			continue
+		}
+		for _, note := range staff.Notes() {
+			if !note.Rest {
+				used[note.Pitch] = true
+			}
+		}
+	}
+	drums := make([]score.DrumSound, 0, len(used))
+	for _, d := range score.GMDrums {
+		if used[d.Key] {
+			drums = append(drums, d)
+			delete(used, d.Key)
+		}
+	}
+	/* anything outside the kit is listed by number */
+	keys := make([]int, 0, len(used))
+	for key := range used {
+		keys = append(keys, int(key))
+	}
+	sort.Ints(keys)
+	for _, key := range keys {
+		drums = append(drums, score.DrumSound{Key: uint8(key), Name: fmt.Sprintf("Percussion %d", key)})
+	}
+	return drums
+}
+
 func rat(n, d int64) *big.Rat {
 	return big.NewRat(n, d)
 }
@@ -150,81 +207,519 @@ func (iter NotePosIter) Pos() *big.Rat {
 	return b
 }
 
-func mxmlPart(wr *XMLWriter, staff *score.Staff, id string) {
-	iter := &NotePosIter{notes: staff.Notes()}
+/* mxmlPiece is a note (or part of a note) to be written within a measure. A nil
+ * 'spelled' marks an explicit rest. */
+type mxmlPiece struct {
+	staff, voice int // indices within the part and staff
+	tick, ticks int
+	spelled *score.Spelled
+	ntype mxmlType
+	tieStop, tieStart bool
+	tupletStop, tupletStart bool // ends or begins a tuplet bracket
+	artic score.Articulation // marked on the first piece of a note only
+	placeholder bool // stands in for an empty voice; nothing is written
+}
+
+type mxmlPieces []mxmlPiece
+
+func (p mxmlPieces) Len() int { return len(p) }
+func (p mxmlPieces) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p mxmlPieces) Less(i, j int) bool {
+	if p[i].staff != p[j].staff {
+		return p[i].staff < p[j].staff
+	}
+	if p[i].voice != p[j].voice {
+		return p[i].voice < p[j].voice
+	}
+	return p[i].tick < p[j].tick
+}
+
+/* chord returns true if 'p' is written as part of a chord with 'prev' */
+func (prev mxmlPiece) chord(p mxmlPiece) bool {
+	return p.staff == prev.staff && p.voice == prev.voice && p.tick == prev.tick && p.ticks == prev.ticks && p.spelled != nil && prev.spelled != nil
+}
+
+/* bracket marks where tuplet brackets start and stop. A bracket covers consecutive
+ * values of the same tuplet in one voice, up to the length of a full group (eg. three
+ * triplet eighths). Only the first note of a chord is marked. */
+func (pieces mxmlPieces) bracket(divisions int) {
+	var open *mxmlPiece // last piece of the bracket being built
+	end := 0 // tick at which the open bracket's group is complete
+	close := func() {
+		if open != nil {
+			open.tupletStop = true
+			open = nil
+		}
+	}
+	for i := range pieces {
+		p := &pieces[i]
+		if p.placeholder || (i > 0 && pieces[i-1].chord(*p)) {
+			continue
+		}
+		if open != nil && (p.staff != open.staff || p.voice != open.voice || p.tick != open.tick + open.ticks || p.ntype.actual != open.ntype.actual) {
+			close()
+		}
+		if p.ntype.actual == 0 {
+			continue
+		}
+		if open == nil {
+			p.tupletStart = true
+			group := new(big.Rat).Mul(p.ntype.quarters, rat(int64(p.ntype.actual), 1))
+			end = p.tick + dur2ticks(group, divisions)
+		}
+		open = p
+		if p.tick + p.ticks >= end {
+			close()
+		}
+	}
+	close()
+}
+
+/* mxmlVoice numbers the piece's voice uniquely within the part */
+func (p mxmlPiece) mxmlVoice() int {
+	return p.staff * score.NVoices + p.voice + 1
+}
+
+/* mxmlStaff numbers the piece's staff within the part, or returns 0 if the part only
+ * has the one staff */
+func (p mxmlPiece) mxmlStaff(multi bool) int {
+	if !multi {
+		return 0
+	}
+	return p.staff + 1
+}
+
+/* mxmlMidKey is a key change part way through a measure */
+type mxmlMidKey struct {
+	tick int
+	key score.KeySig
+	mode score.Mode
+}
+
+/* mxmlCarry is the remainder of a note which continues over a barline */
+type mxmlCarry struct {
+	voice int
+	spelled *score.Spelled
+	quarters *big.Rat
+	tied bool // tied into the following note
+}
+
+/* mxmlStaffOut tracks the progress through one staff of a part */
+type mxmlStaffOut struct {
+	staff *score.Staff
+	iter *NotePosIter
+	spelled map[*score.Note]score.Spelled
+	carry []mxmlCarry
+	key score.KeySig
+	mode score.Mode
+}
+
+/* mxmlPart writes the staves of a part as a single musicxml part. Each staff's voices are
+ * numbered after those of the staves above it. */
+func mxmlPart(wr *XMLWriter, part []*score.Staff, id string) {
+	sc := G.score
 	defer wr.CloseTag(wr.Tag("part", "id", id))
-	ticks := 384
-	divisions := ticks/4
+	if !sc.HasBeats() {
+		return
+	}
+	outs := make([]*mxmlStaffOut, len(part))
+	for k, staff := range part {
+		iter := &NotePosIter{notes: staff.Notes()}
+		iter.advance()
+		spelled := sc.Spell(staff, FrameRange{Min: sc.Head.Frame(), Max: sc.Tail.Frame()})
+		outs[k] = &mxmlStaffOut{staff: staff, iter: iter, spelled: spelled, carry: make([]mxmlCarry, 0)}
+	}
+	remaining := func() bool {
+		for _, out := range outs {
+			if out.iter.Note != nil || len(out.carry) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	multi := len(part) > 1
+	divisions := mxmlDivisions(part)
+	bar0 := sc.Head // first beat of the current measure
+	pos := sc.BarPos(bar0)
 	i0 := 0 // beat index of measure start
-	m := 1 // number of measure
-	for !iter.done() {
+	var last *score.BeatRef // last beat of the measure
+	for m := 1; remaining() || m == 1 || mxmlDynamicsFrom(part, i0); m++ {
 		meas := wr.Tag("measure", "number", m)
-		if m == 1 {
-			iter.advance()
+		ts := pos.TimeSig
+		newMeter := m == 1 || (bar0 != nil && sc.TimeSigChangeAt(bar0) != nil)
+		/* find the start of the next measure; a time signature change can cut this one short */
+		nbeats, barN := 0, bar0
+		for barN != nil {
+			pos = sc.NextBarPos(barN, pos)
+			last, barN = barN, barN.Next()
+			nbeats++
+			if pos.IsDownbeat() {
+				break
+			}
+		}
+		if barN == nil {
+			nbeats = ts.Beats // ran out of beats; fill out the measure
+		}
+		iN := i0 + nbeats
+		beatTicks := divisions * 4 / ts.Unit
+		/* key changes on the downbeat are written with the measure's attributes, and those
+		 * within the measure where they happen, in each staff's first voice */
+		at := bar0
+		if at == nil {
+			at = last // past the last beat, where nothing changes
+		}
+		newKeys := make([]bool, len(outs))
+		newKey := false
+		midKeys := make([][]mxmlMidKey, len(outs))
+		for k, out := range outs {
+			keysig, mode := out.staff.WrittenKeyAt(at)
+			newKeys[k] = m == 1 || keysig != out.key || mode != out.mode
+			newKey = newKey || newKeys[k]
+			out.key, out.mode = keysig, mode
+			for _, kc := range out.staff.KeySigChanges() {
+				if i := kc.Beat.BeatNum() - 1; i > i0 && i < iN {
+					keysig, mode := out.staff.WrittenKeyAt(kc.Beat)
+					if keysig != out.key || mode != out.mode {
+						midKeys[k] = append(midKeys[k], mxmlMidKey{(i - i0) * beatTicks, keysig, mode})
+						out.key, out.mode = keysig, mode
+					}
+				}
+			}
+		}
+		if newMeter || newKey {
 			attr := wr.Tag("attributes")
-			wr.ContentTag("divisions", divisions)
-			key := wr.Tag("key")
-			wr.ContentTag("fifths", int(staff.Key()))
-			wr.ContentTag("mode", "major")
-			wr.CloseTag(key)
-			time := wr.Tag("time")
-			wr.ContentTag("beats", 4)
-			wr.ContentTag("beat-type", 4)
-			wr.CloseTag(time)
-			mxmlClef(wr, staff.Clef().Origin)
+			if m == 1 {
+				wr.ContentTag("divisions", divisions)
+			}
+			for k, out := range outs {
+				if !newKeys[k] {
+					continue
+				}
+				number := 0
+				if multi {
+					number = k + 1
+				}
+				keysig, mode := out.staff.WrittenKeyAt(at)
+				mxmlWriteKey(wr, keysig, mode, number)
+			}
+			if newMeter {
+				time := wr.Tag("time")
+				wr.ContentTag("beats", ts.Beats)
+				wr.ContentTag("beat-type", ts.Unit)
+				wr.CloseTag(time)
+			}
+			if m == 1 {
+				if multi {
+					wr.ContentTag("staves", len(outs))
+				}
+				for k, out := range outs {
+					number := 0
+					if multi {
+						number = k + 1
+					}
+					mxmlClef(wr, out.staff.Clef(), number)
+				}
+				for k, out := range outs {
+					if t := out.staff.Transposition(); t != 0 {
+						number := 0
+						if multi {
+							number = k + 1
+						}
+						mxmlTranspose(wr, t, number)
+					}
+				}
+			}
 			wr.CloseTag(attr)
 		}
-		iN := i0 + 4
-		curtick := (m - 1) * ticks
-		var prevOffset *big.Rat
-		for !iter.done() && flt(iter.Pos()) < float64(iN) {
-			tick0 := dur2ticks(rat(1,4).Mul(rat(1,4), iter.Pos()), ticks)
-			chord := false
-			if prevOffset != nil && iter.Pos().Cmp(prevOffset) == 0 {
-				chord = true
+		ticks := nbeats * beatTicks
+		toQuarters := rat(4, int64(ts.Unit))
+		length := rat(int64(nbeats), 1)
+		/* dynamics and hairpins are placed by offset from the start of the measure */
+		dirs := make([][]mxmlDirection, len(outs))
+		for k, out := range outs {
+			for _, dm := range out.staff.Dynamics() {
+				if i := dm.Beat.BeatNum() - 1; i >= i0 && i < iN {
+					tick := (i - i0) * beatTicks
+					if dm.Level != score.NoDynamic {
+						dirs[k] = append(dirs[k], mxmlDirection{tick, "dynamics", dm.Level.String()})
+					}
+					if dm.Hairpin > 0 && dm.End != nil {
+						dirs[k] = append(dirs[k], mxmlDirection{tick, "wedge", "crescendo"})
+					} else if dm.Hairpin < 0 && dm.End != nil {
+						dirs[k] = append(dirs[k], mxmlDirection{tick, "wedge", "diminuendo"})
+					}
+				}
+				if dm.Hairpin == 0 || dm.End == nil {
+					continue
+				}
+				if i := dm.End.BeatNum() - 1; i >= i0 && i < iN {
+					dirs[k] = append(dirs[k], mxmlDirection{(i - i0) * beatTicks, "wedge", "stop"})
+				}
+			}
+		}
+		pieces := make(mxmlPieces, 0)
+		for k, out := range outs {
+			out := out
+			/* adds a note (or rest, if 'sp' is nil) starting 'start' beats into the measure,
+			 * split into representable durations and tied across the barline if necessary.
+			 * 'tiedIn' and 'tied' are the note's own ties to the notes either side, and 'artic'
+			 * its articulations. */
+			add := func(voice int, sp *score.Spelled, start, dur *big.Rat, tiedIn, tied bool, artic score.Articulation) {
+				end := new(big.Rat).Add(start, dur)
+				tiedOut := tied
+				if end.Cmp(length) > 0 {
+					out.carry = append(out.carry, mxmlCarry{voice, sp, new(big.Rat).Mul(new(big.Rat).Sub(end, length), toQuarters), tied})
+					end = length
+					tiedOut = true
+				}
+				types := mxmlNoteTypes(new(big.Rat).Mul(new(big.Rat).Sub(end, start), toQuarters))
+				q := new(big.Rat).Mul(start, toQuarters)
+				for i, t := range types {
+					tick := dur2ticks(q, divisions)
+					q.Add(q, t.quarters)
+					if i == len(types) - 1 {
+						q.Mul(end, toQuarters) // absorb any unrepresentable remainder
+					}
+					n := dur2ticks(q, divisions) - tick
+					if n < 1 {
+						n = 1 // too short for the divisions, but still a note
+					}
+					tie := sp != nil // rests are never tied
+					var a score.Articulation
+					if i == 0 {
+						a = artic
+					}
+					pieces = append(pieces, mxmlPiece{staff: k, voice: voice, tick: tick, ticks: n, spelled: sp, ntype: t,
+						tieStop: tie && (tiedIn || i > 0), tieStart: tie && (tiedOut || i < len(types) - 1), artic: a})
+				}
+			}
+			carried := out.carry
+			out.carry = make([]mxmlCarry, 0)
+			for _, c := range carried {
+				add(c.voice, c.spelled, rat(0, 1), new(big.Rat).Quo(c.quarters, toQuarters), true, c.tied, 0)
+			}
+			iter, staff := out.iter, out.staff
+			for iter.Note != nil && iter.Pos().Cmp(rat(int64(iN), 1)) < 0 {
+				rel := rat(int64(-i0), 1)
+				rel.Add(rel, iter.Pos())
+				note := iter.Note
+				if note.Rest {
+					add(int(note.Voice), nil, rel, note.Duration, false, false, 0)
+				} else {
+					sp, ok := out.spelled[note]
+					if !ok {
+						sp = staff.SpellNote(note)
+					}
+					add(int(note.Voice), &sp, rel, note.Duration, staff.TiedFrom(note) != nil, staff.TiedTo(note) != nil, note.Articulations)
+				}
+				iter.advance()
+			}
+		}
+		/* each voice is written in turn, backing up to the start of the measure between them.
+		 * Gaps in the first voice of each staff are filled with rests, while later voices skip
+		 * forward. */
+		curtick := 0
+		cur := mxmlPiece{} // staff and voice being written
+		backup := func(to int) {
+			if curtick > to {
+				tag := wr.Tag("backup")
+				wr.ContentTag("duration", curtick - to)
+				wr.CloseTag(tag)
+				curtick = to
+			}
+		}
+		gap := func(to int) {
+			if to <= curtick {
+				return
+			} else if cur.voice == 0 {
+				mxmlRest(wr, cur.mxmlVoice(), cur.mxmlStaff(multi), to - curtick, divisions)
 			} else {
-				if tick0 < curtick {
-					backup := wr.Tag("backup")
-					wr.ContentTag("duration", curtick - tick0)
-					wr.CloseTag(backup)
-				} else if tick0 > curtick {
-					mxmlRest(wr ,tick0 - curtick, divisions)
+				fwd := wr.Tag("forward")
+				wr.ContentTag("duration", to - curtick)
+				wr.ContentTag("voice", cur.mxmlVoice())
+				if multi {
+					wr.ContentTag("staff", cur.mxmlStaff(multi))
 				}
+				wr.CloseTag(fwd)
+			}
+			curtick = to
+		}
+		/* writes the key changes of the current staff up to 'to', if it's the first voice */
+		keysTo := func(to int) {
+			if cur.voice != 0 {
+				return
+			}
+			for len(midKeys[cur.staff]) > 0 && midKeys[cur.staff][0].tick <= to {
+				kc := midKeys[cur.staff][0]
+				midKeys[cur.staff] = midKeys[cur.staff][1:]
+				gap(kc.tick)
+				attr := wr.Tag("attributes")
+				mxmlWriteKey(wr, kc.key, kc.mode, cur.mxmlStaff(multi))
+				wr.CloseTag(attr)
+			}
+		}
+		/* every staff gets at least its first voice, even if that's just a whole rest */
+		for k := range outs {
+			pieces = append(pieces, mxmlPiece{staff: k, tick: ticks, placeholder: true})
+		}
+		sort.Stable(pieces)
+		pieces.bracket(divisions)
+		dirsDone := make([]bool, len(outs))
+		for i, p := range pieces {
+			if p.staff != cur.staff || p.voice != cur.voice {
+				if cur.voice == 0 {
+					keysTo(ticks)
+					gap(ticks) /* insert rest to finish out the measure */
+				}
+				backup(0)
+				cur = p
+			}
+			if !dirsDone[p.staff] {
+				for _, d := range dirs[p.staff] {
+					mxmlDirect(wr, d, d.tick - curtick, p.mxmlStaff(multi))
+				}
+				dirsDone[p.staff] = true
+			}
+			if p.placeholder {
+				continue
 			}
-			prevOffset = iter.Pos()
-			note := iter.Note
-			durticks := dur2ticks(note.Duration, divisions)
-			if durticks <= 0 {
-				durticks = 1
+			chord := i > 0 && pieces[i-1].chord(p)
+			if !chord {
+				backup(p.tick)
+				keysTo(p.tick)
+				gap(p.tick)
 			}
-			mxmlNote(wr, &note.Pitch, note.Duration, durticks, chord)
-			curtick = tick0 + durticks
-			iter.advance()
+			mxmlNote(wr, id, p.spelled, p.mxmlVoice(), p.mxmlStaff(multi), p.ntype, p.ticks, chord, p.tieStop, p.tieStart, p.tupletStop, p.tupletStart, p.artic)
+			curtick = p.tick + p.ticks
 		}
-		if ticks > curtick {
-			mxmlRest(wr, ticks - curtick, divisions) /* insert rest to finish out the measure */
+		if cur.voice == 0 {
+			keysTo(ticks)
+			gap(ticks)
 		}
 		wr.CloseTag(meas)
 
 		i0 = iN
-		m++
+		bar0 = barN
 	}
 }
 
-func mxmlClef(wr *XMLWriter, origin uint8) {
-	defer wr.CloseTag(wr.Tag("clef"))
-	if origin == midi.PitchB5 {
+/* mxmlDynamicsFrom returns true if any staff of 'part' has dynamics or the end of a
+ * hairpin at or after beat index 'i0' */
+func mxmlDynamicsFrom(part []*score.Staff, i0 int) bool {
+	for _, staff := range part {
+		for _, dm := range staff.Dynamics() {
+			if dm.Beat.BeatNum() - 1 >= i0 || (dm.End != nil && dm.End.BeatNum() - 1 >= i0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* mxmlDirection is a dynamic or the start or end of a hairpin, 'tick' into the measure */
+type mxmlDirection struct {
+	tick int
+	kind string // "dynamics" or "wedge"
+	value string // eg. "mf" or "crescendo"
+}
+
+/* mxmlDirect writes a direction 'offset' ticks from the current position */
+func mxmlDirect(wr *XMLWriter, d mxmlDirection, offset, staff int) {
+	defer wr.CloseTag(wr.Tag("direction", "placement", "below"))
+	dt := wr.Tag("direction-type")
+	if d.kind == "dynamics" {
+		dyn := wr.Tag("dynamics")
+		wr.EmptyTag(d.value)
+		wr.CloseTag(dyn)
+	} else {
+		wr.EmptyTag(fmt.Sprintf(`wedge type="%s"`, d.value))
+	}
+	wr.CloseTag(dt)
+	if offset != 0 {
+		wr.ContentTag("offset", offset)
+	}
+	if staff > 0 {
+		wr.ContentTag("staff", staff)
+	}
+}
+
+/* mxmlWriteKey writes a key signature, for staff 'number' of the part or all of them if 0 */
+func mxmlWriteKey(wr *XMLWriter, keysig score.KeySig, mode score.Mode, number int) {
+	if number > 0 {
+		defer wr.CloseTag(wr.Tag("key", "number", number))
+	} else {
+		defer wr.CloseTag(wr.Tag("key"))
+	}
+	wr.ContentTag("fifths", int(keysig))
+	wr.ContentTag("mode", strings.ToLower(mode.String()))
+}
+
+/* mxmlClef writes a clef; 'number' picks the staff within the part, 0 for a lone staff */
+func mxmlClef(wr *XMLWriter, clef *score.Clef, number int) {
+	if number > 0 {
+		defer wr.CloseTag(wr.Tag("clef", "number", number))
+	} else {
+		defer wr.CloseTag(wr.Tag("clef"))
+	}
+	origin := clef.Origin
+	if clef.IsPercussion() {
+		wr.ContentTag("sign", "percussion")
+	} else if origin == midi.PitchB5 {
 		wr.ContentTag("sign", "G")
 		wr.ContentTag("line", 2)
 	} else if origin == midi.PitchD4 {
 		wr.ContentTag("sign", "F")
 		wr.ContentTag("line", 4)
+	} else if origin == midi.PitchA4 {
+		wr.ContentTag("sign", "C")
+		wr.ContentTag("line", 4)
 	} else {
 		wr.ContentTag("sign", midi.PitchName(origin)[0:1])
 		wr.ContentTag("line", 3)
 	}
 }
 
+/* mxmlTranspose writes the interval from written to sounding pitch, in 'semitones' */
+func mxmlTranspose(wr *XMLWriter, semitones, number int) {
+	if number > 0 {
+		defer wr.CloseTag(wr.Tag("transpose", "number", number))
+	} else {
+		defer wr.CloseTag(wr.Tag("transpose"))
+	}
+	octaves := semitones / 12
+	semitones -= octaves * 12
+	wr.ContentTag("diatonic", score.Diatonic(semitones))
+	wr.ContentTag("chromatic", semitones)
+	if octaves != 0 {
+		wr.ContentTag("octave-change", octaves)
+	}
+}
+
+/* mxmlMaxDivisions bounds the ticks per quarter note; notes needing finer divisions than
+ * this are rounded to the nearest tick */
+const mxmlMaxDivisions = 10080
+
+/* mxmlDivisions returns the ticks per quarter note needed to place and time every note
+ * of 'part' exactly. It is at least 96, which covers triplets down to 64ths. */
+func mxmlDivisions(part []*score.Staff) int {
+	sc := G.score
+	divisions := big.NewInt(96)
+	for _, staff := range part {
+		for _, note := range staff.Notes() {
+			toQuarters := rat(4, int64(sc.TimeSigAt(note.Beat).Unit))
+			for _, r := range []*big.Rat{note.Offset, note.Duration} {
+				d := new(big.Rat).Mul(r, toQuarters).Denom()
+				lcm := new(big.Int).GCD(nil, nil, divisions, d)
+				lcm.Mul(new(big.Int).Quo(divisions, lcm), d)
+				if lcm.Cmp(big.NewInt(mxmlMaxDivisions)) <= 0 {
+					divisions = lcm
+				}
+			}
+		}
+	}
+	return int(divisions.Int64())
+}
+
 func dur2ticks(duration *big.Rat, divisions int) int {
 	dur := big.NewRat(int64(divisions), 1)
 	dur.Mul(dur, duration)
@@ -235,23 +730,24 @@ func dur2ticks(duration *big.Rat, divisions int) int {
 	return ticks
 }
 
-func ticks2dur(ticks, divisions int) *big.Rat {
-	r := []*big.Rat{rat(1,128), rat(3,256), rat(1,64), rat(3,128), rat(1,32), rat(3,64), rat(1,16), rat(3,32), rat(1,8), rat(3,16), rat(1,4), rat(3,8), rat(1,2), rat(3,4), rat(1,1), rat(3,2), rat(2,1), rat(3,1), rat(4,1)}
-	d := float64(ticks) / float64(divisions)
-	for i := 0; i + 1 < len(r); i++ {
-		if d < (flt(r[i]) + flt(r[i + 1])) / 2 {
-			return r[i]
+/* mxmlRest writes rests filling 'ticks' */
+func mxmlRest(wr *XMLWriter, voice, staff, ticks, divisions int) {
+	q := rat(0, 1)
+	types := mxmlNoteTypes(rat(int64(ticks), int64(divisions)))
+	for i, t := range types {
+		tick := dur2ticks(q, divisions)
+		q.Add(q, t.quarters)
+		if i == len(types) - 1 {
+			q = rat(int64(ticks), int64(divisions))
 		}
+		/* any tuplet values come last, and share a bracket */
+		start := t.actual != 0 && (i == 0 || types[i-1].actual == 0)
+		mxmlNote(wr, "", nil, voice, staff, t, dur2ticks(q, divisions) - tick, false, false, false, t.actual != 0 && i == len(types) - 1, start, 0)
 	}
-	return r[len(r) - 1]
-}
-
-func mxmlRest(wr *XMLWriter, ticks, divisions int) {
-	dur := ticks2dur(ticks, divisions)
-	mxmlNote(wr, nil, dur, ticks, false)
 }
 
-func mxmlNote(wr *XMLWriter, pitch *uint8, duration *big.Rat, ticks int, chord bool) {
+/* mxmlNote writes a note of part 'part', or a rest if 'pitch' is nil */
+func mxmlNote(wr *XMLWriter, part string, pitch *score.Spelled, voice, staff int, ntype mxmlType, ticks int, chord, tieStop, tieStart, tupletStop, tupletStart bool, artic score.Articulation) {
 	defer wr.CloseTag(wr.Tag("note"))
 	if chord {
 		wr.EmptyTag("chord")
@@ -262,38 +758,155 @@ func mxmlNote(wr *XMLWriter, pitch *uint8, duration *big.Rat, ticks int, chord b
 		wr.EmptyTag("rest")
 	}
 	wr.ContentTag("duration", ticks)
-	wr.ContentTag("voice", 1)
-	ntype, dot := mxmlNoteType(duration)
-	wr.ContentTag("type", ntype)
-	if dot {
+	if tieStop {
+		wr.EmptyTag(`tie type="stop"`)
+	}
+	if tieStart {
+		wr.EmptyTag(`tie type="start"`)
+	}
+	if pitch != nil && pitch.Unpitched() {
+		wr.EmptyTag(fmt.Sprintf(`instrument id="%s"`, mxmlInstId(part, pitch.Drum)))
+	}
+	wr.ContentTag("voice", voice)
+	wr.ContentTag("type", ntype.name)
+	for i := 0; i < ntype.dots; i++ {
 		wr.EmptyTag("dot")
 	}
+	if pitch != nil && pitch.Show && !tieStop {
+		wr.ContentTag("accidental", mxmlAccidentals[pitch.Accidental + 2])
+	}
+	if ntype.actual != 0 {
+		tm := wr.Tag("time-modification")
+		wr.ContentTag("actual-notes", ntype.actual)
+		wr.ContentTag("normal-notes", ntype.normal)
+		wr.CloseTag(tm)
+	}
+	if pitch != nil && pitch.Unpitched() {
+		if d, ok := score.FindDrum(pitch.Drum); ok && d.Cross {
+			wr.ContentTag("notehead", "x")
+		}
+	}
+	if staff > 0 {
+		wr.ContentTag("staff", staff)
+	}
+	if tieStop || tieStart || tupletStop || tupletStart || artic != 0 {
+		notations := wr.Tag("notations")
+		if tieStop {
+			wr.EmptyTag(`tied type="stop"`)
+		}
+		if tieStart {
+			wr.EmptyTag(`tied type="start"`)
+		}
+		if tupletStart {
+			wr.EmptyTag(`tuplet type="start"`)
+		}
+		if tupletStop {
+			wr.EmptyTag(`tuplet type="stop"`)
+		}
+		if artic &^ score.Fermata != 0 {
+			arts := wr.Tag("articulations")
+			for _, a := range score.Articulations {
+				if a != score.Fermata && artic.Has(a) {
+					wr.EmptyTag(a.String())
+				}
+			}
+			wr.CloseTag(arts)
+		}
+		if artic.Has(score.Fermata) {
+			wr.EmptyTag(`fermata type="upright"`)
+		}
+		wr.CloseTag(notations)
+	}
 }
 
-func mxmlPitch(wr *XMLWriter, pitch uint8) {
+var mxmlAccidentals = []string{"flat-flat", "flat", "natural", "sharp", "double-sharp"}
+
+func mxmlPitch(wr *XMLWriter, sp score.Spelled) {
+	if sp.Unpitched() {
+		defer wr.CloseTag(wr.Tag("unpitched"))
+		wr.ContentTag("display-step", sp.Step())
+		wr.ContentTag("display-octave", sp.Octave() - 1)
+		return
+	}
 	defer wr.CloseTag(wr.Tag("pitch"))
-	s := midi.PitchName(pitch)
-	wr.ContentTag("step", s[0:1])
-	if s[1] == '#' {
-		wr.ContentTag("alter", 1)
-	} else if s[1] == 'b' {
-		wr.ContentTag("alter", -1)
-	}
-	octave, _ := strconv.Atoi(s[len(s) - 1:])
-	wr.ContentTag("octave", octave - 1)
-}
-
-func mxmlNoteType(dur *big.Rat) (string, bool) {
-	switch dur.RatString() {
-	case "1/32": return "128th", false
-	case "1/16": return "64th", false
-	case "1/8": return "32nd", false
-	case "1/4": return "16th", false
-	case "1/2": return "eighth", false
-	case "1": return "quarter", false
-	case "2": return "half", false
-	case "3": return "half", true
-	case "4": return "whole", false
-	}
-	return "quarter", false
+	wr.ContentTag("step", sp.Step())
+	if sp.Accidental != 0 {
+		wr.ContentTag("alter", sp.Accidental)
+	}
+	wr.ContentTag("octave", sp.Octave() - 1)
+}
+
+/* mxmlType is a written note value; 'quarters' is its length in quarter notes. Tuplet
+ * values are played 'actual' to the time of 'normal' plain ones. */
+type mxmlType struct {
+	name string
+	dots int
+	actual, normal int // 0 for plain values
+	quarters *big.Rat
+}
+
+/* mxmlTypes lists every plain value, longest first */
+var mxmlTypes = func() []mxmlType {
+	names := []string{"whole", "half", "quarter", "eighth", "16th", "32nd", "64th", "128th"}
+	types := make([]mxmlType, 0, 3 * len(names))
+	for i, name := range names {
+		q := rat(4, 1 << uint(i))
+		types = append(types,
+			mxmlType{name, 2, 0, 0, new(big.Rat).Mul(q, rat(7, 4))},
+			mxmlType{name, 1, 0, 0, new(big.Rat).Mul(q, rat(3, 2))},
+			mxmlType{name, 0, 0, 0, q})
+	}
+	return types
+}()
+
+/* mxmlTuplets maps the tuplets written to the number of plain values they replace */
+var mxmlTuplets = []struct{ actual, normal int }{{3, 2}, {5, 4}}
+
+/* mxmlNoteTypes breaks a duration (in quarter notes) into written values to be tied
+ * together. Whole quarters are written as plain values, followed by the fraction of a
+ * quarter left over, using triplet or quintuplet values when it needs them. A remainder
+ * which can't be written exactly (a septuplet, or anything shorter than a 128th) gets
+ * the shortest value rather than being dropped. At least one value is always returned. */
+func mxmlNoteTypes(quarters *big.Rat) []mxmlType {
+	whole := new(big.Rat).SetInt(new(big.Int).Quo(quarters.Num(), quarters.Denom()))
+	frac := new(big.Rat).Sub(quarters, whole)
+	types := mxmlValues(whole, 0, 0)
+	actual, normal := 0, 0
+	for _, t := range mxmlTuplets {
+		if new(big.Int).Rem(frac.Denom(), big.NewInt(int64(t.actual))).Sign() == 0 {
+			actual, normal = t.actual, t.normal
+			break
+		}
+	}
+	types = append(types, mxmlValues(frac, actual, normal)...)
+	if len(types) == 0 {
+		types = append(types, mxmlTypes[len(mxmlTypes) - 1])
+	}
+	return types
+}
+
+/* mxmlValues splits 'quarters' into values of the given tuplet, or plain values if
+ * 'actual' is 0, longest first */
+func mxmlValues(quarters *big.Rat, actual, normal int) []mxmlType {
+	scale := rat(1, 1)
+	if actual != 0 {
+		scale = rat(int64(normal), int64(actual))
+	}
+	left := new(big.Rat).Quo(quarters, scale)
+	types := make([]mxmlType, 0, 1)
+	add := func(t mxmlType) {
+		t.actual, t.normal = actual, normal
+		t.quarters = new(big.Rat).Mul(t.quarters, scale)
+		types = append(types, t)
+	}
+	for _, t := range mxmlTypes {
+		for left.Cmp(t.quarters) >= 0 {
+			add(t)
+			left.Sub(left, t.quarters)
+		}
+	}
+	if left.Sign() > 0 {
+		add(mxmlTypes[len(mxmlTypes) - 1])
+	}
+	return types
 }
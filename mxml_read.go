@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sqweek/sqribe/midi"
+	"github.com/sqweek/sqribe/score"
+)
+
+type mxmlDoc struct {
+	PartList []mxmlScorePart `xml:"part-list>score-part"`
+	Parts []mxmlDocPart `xml:"part"`
+}
+
+type mxmlScorePart struct {
+	Id string `xml:"id,attr"`
+	Name string `xml:"part-name"`
+	Midi []mxmlMidiInst `xml:"midi-instrument"`
+}
+
+type mxmlMidiInst struct {
+	Id string `xml:"id,attr"`
+	Program int `xml:"midi-program"` // 1-based
+	Unpitched int `xml:"midi-unpitched"` // 1-based
+}
+
+/* program returns the part's (1-based) midi program, or 0 if it doesn't say */
+func (sp mxmlScorePart) program() int {
+	for _, inst := range sp.Midi {
+		if inst.Program > 0 {
+			return inst.Program
+		}
+	}
+	return 0
+}
+
+type mxmlDocPart struct {
+	Id string `xml:"id,attr"`
+	Measures []mxmlDocMeasure `xml:"measure"`
+}
+
+type mxmlDocMeasure struct {
+	Implicit string `xml:"implicit,attr"`
+	Elems []mxmlElem `xml:",any"`
+}
+
+/* mxmlElem holds any of <attributes>, <note>, <backup> or <forward>, which need to be
+ * processed in document order */
+type mxmlElem struct {
+	XMLName xml.Name
+
+	/* <attributes> */
+	Divisions int `xml:"divisions"`
+	Key *mxmlKey `xml:"key"`
+	Time *mxmlTime `xml:"time"`
+	Clefs []mxmlClefIn `xml:"clef"`
+	Transposes []mxmlTransposeIn `xml:"transpose"`
+
+	/* <note>, <backup>, <forward> */
+	Duration int `xml:"duration"`
+	Chord *struct{} `xml:"chord"`
+	Grace *struct{} `xml:"grace"`
+	Pitch *mxmlPitchIn `xml:"pitch"`
+	Unpitched *mxmlUnpitchedIn `xml:"unpitched"`
+	Instrument *struct{Id string `xml:"id,attr"`} `xml:"instrument"`
+	Staff int `xml:"staff"`
+	Voice int `xml:"voice"`
+	Ties []mxmlTie `xml:"tie"`
+	Rest *struct{} `xml:"rest"`
+}
+
+type mxmlKey struct {
+	Fifths int `xml:"fifths"`
+	Mode string `xml:"mode"`
+}
+
+type mxmlTime struct {
+	Beats string `xml:"beats"`
+	Unit int `xml:"beat-type"`
+}
+
+type mxmlClefIn struct {
+	Number int `xml:"number,attr"`
+	Sign string `xml:"sign"`
+	Line int `xml:"line"`
+}
+
+type mxmlTransposeIn struct {
+	Number int `xml:"number,attr"`
+	Chromatic int `xml:"chromatic"`
+	OctaveChange int `xml:"octave-change"`
+}
+
+type mxmlPitchIn struct {
+	Step string `xml:"step"`
+	Alter int `xml:"alter"`
+	Octave int `xml:"octave"`
+}
+
+type mxmlUnpitchedIn struct {
+	Step string `xml:"display-step"`
+	Octave int `xml:"display-octave"`
+}
+
+type mxmlTie struct {
+	Type string `xml:"type,attr"`
+}
+
+func (p *mxmlPitchIn) midi() (uint8, error) {
+	return midi.ParsePitch(p.Step + strconv.Itoa(p.Octave + 1)) // musicxml's octave 4 starts at middle C
+}
+
+/* importFile reads midi or musicxml, depending on the file extension */
+func importFile(filename string) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".xml", ".musicxml":
+		return ImportMXML(filename)
+	}
+	return ImportSMF(filename)
+}
+
+/* clefs by sign and line */
+var mxmlClefs = map[string]*score.Clef{
+	"G2": &score.TrebleClef,
+	"F4": &score.BassClef,
+	"C3": &score.AltoClef,
+	"C4": &score.TenorClef,
+}
+
+/* mxmlStaff accumulates the notes of one staff of a part */
+type mxmlStaff struct {
+	key score.KeySig // starting key
+	mode score.Mode
+	keys []mxmlKeyChange
+	clef *score.Clef
+	transpose int // semitones from written to sounding pitch
+	notes []*score.Note
+	pitchSum, npitched int
+	tied map[mxmlTieKey]*score.Note // notes awaiting a tie stop
+	voices map[int]uint8 // musicxml voice numbers, in order of appearance
+}
+
+/* mxmlTieKey identifies the note a tie continues: the same pitch in the same voice */
+type mxmlTieKey struct {
+	voice uint8
+	pitch uint8
+}
+
+/* voice maps a musicxml voice number to one of the staff's voices */
+func (st *mxmlStaff) voice(n int) uint8 {
+	if v, ok := st.voices[n]; ok {
+		return v
+	}
+	v := uint8(len(st.voices))
+	if v >= score.NVoices {
+		v = score.NVoices - 1
+	}
+	st.voices[n] = v
+	return v
+}
+
+/* mxmlKeyChange is a modulation at a beat position */
+type mxmlKeyChange struct {
+	pos *big.Rat
+	key score.KeySig
+	mode score.Mode
+}
+
+/* ImportMXML reads a score-partwise file, adding a staff for each staff of each part and
+ * joining the staves of a part together. Measures are laid onto the existing beats in
+ * order, starting with the first beat. */
+func ImportMXML(filename string) error {
+	sc := G.score
+	if !sc.HasBeats() {
+		return fmt.Errorf("musicxml import needs some beats to attach the notes to")
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	var doc mxmlDoc
+	err = xml.NewDecoder(file).Decode(&doc)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	beats := make([]*score.BeatRef, 0)
+	for b := sc.Head; b != nil; b = b.Next() {
+		beats = append(beats, b)
+	}
+	/* locates the beat 'pos' beats after the first, extrapolating past the last */
+	locate := func(pos *big.Rat) (*score.BeatRef, *big.Rat) {
+		whole := new(big.Int).Quo(pos.Num(), pos.Denom())
+		i := int(whole.Int64())
+		offset := new(big.Rat).Sub(pos, new(big.Rat).SetInt(whole))
+		if i >= len(beats) {
+			offset.Add(offset, big.NewRat(int64(i - len(beats) + 1), 1))
+			i = len(beats) - 1
+		}
+		return beats[i], offset
+	}
+	sigs := make(map[int]score.TimeSig)
+	names := make(map[string]mxmlScorePart)
+	drums := make(map[string]uint8) // instrument id -> GM percussion key
+	for _, sp := range doc.PartList {
+		names[sp.Id] = sp
+		for _, inst := range sp.Midi {
+			if inst.Unpitched > 0 {
+				drums[inst.Id] = uint8(inst.Unpitched - 1)
+			}
+		}
+	}
+	/* read everything before touching the score, so a bad part leaves it as it was */
+	parts := make([]map[int]*mxmlStaff, len(doc.Parts))
+	nnotes := 0
+	for i, part := range doc.Parts {
+		staves, err := mxmlReadPart(part, locate, sigs, drums)
+		if err != nil {
+			return fmt.Errorf("part %s: %v", part.Id, err)
+		}
+		for _, st := range staves {
+			nnotes += len(st.notes)
+		}
+		parts[i] = staves
+	}
+	if nnotes == 0 {
+		return fmt.Errorf("%s contains no notes", filename)
+	}
+	/* the import is a single step as far as undo is concerned */
+	sc.Group(func() {
+		for i, part := range doc.Parts {
+			mxmlAddPart(parts[i], names[part.Id], locate)
+		}
+		for i, ts := range sigs {
+			if i < len(beats) && sc.TimeSigAt(beats[i]) != ts {
+				sc.SetTimeSig(beats[i], ts)
+			}
+		}
+	})
+	return nil
+}
+
+/* mxmlAddPart adds the staves read from a part to the score, joined together */
+func mxmlAddPart(staves map[int]*mxmlStaff, name mxmlScorePart, locate func(*big.Rat) (*score.BeatRef, *big.Rat)) {
+	sc := G.score
+	nums := make([]int, 0, len(staves))
+	for n := range staves {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	joined := false // later staves of the part join the first
+	for _, n := range nums {
+		st := staves[n]
+		if len(st.notes) == 0 {
+			continue
+		}
+		clef := st.clef
+		if clef == nil {
+			origin := uint8(midi.PitchB5)
+			if st.npitched > 0 && st.pitchSum / st.npitched < midi.PitchC5 {
+				origin = midi.PitchD4
+			}
+			clef = score.FindClef(origin)
+		}
+		/* the file is at written pitch, while the score holds sounding pitch */
+		if clef.IsPercussion() {
+			st.transpose = 0
+		}
+		for _, note := range st.notes {
+			if pitch := int(note.Pitch) + st.transpose; note.Rest {
+				continue
+			} else if pitch < 0 {
+				note.Pitch = 0
+			} else if pitch > 127 {
+				note.Pitch = 127
+			} else {
+				note.Pitch = uint8(pitch)
+			}
+		}
+		staff := score.MkStaff(name.Name, clef, st.key.Transpose(st.transpose), st.mode)
+		/* rests sit on the middle line, as when entered by hand */
+		for _, note := range st.notes {
+			if note.Rest {
+				note.Pitch = staff.PitchForLine(note.Beat, 0)
+			}
+		}
+		sc.LoadTransposition(staff, st.transpose)
+		if program := name.program(); program > 0 && !joined {
+			Mixer.For(staff).Voice = program - 1
+		}
+		sc.LoadJoined(staff, joined)
+		sc.AddStaff(staff)
+		joined = true
+		score.SortNotes(st.notes) // voices are interleaved by <backup>
+		sc.AddNotes(staff, st.notes...)
+		for _, kc := range st.keys {
+			if beat, offset := locate(kc.pos); offset.Sign() == 0 {
+				sc.SetKey(beat, kc.key.Transpose(st.transpose), kc.mode, staff)
+			}
+		}
+	}
+}
+
+/* mxmlReadPart collects the notes of a part by staff number, recording the beat index of
+ * any time signature which starts on a whole beat in 'sigs'. A time signature given in
+ * a pickup measure is recorded against the measure which follows. 'drums' maps the ids of
+ * unpitched instruments to their GM percussion keys. */
+func mxmlReadPart(part mxmlDocPart, locate func(*big.Rat) (*score.BeatRef, *big.Rat), sigs map[int]score.TimeSig, drums map[string]uint8) (map[int]*mxmlStaff, error) {
+	staves := make(map[int]*mxmlStaff)
+	key0, mode0 := score.KeySig(0), score.Major
+	transpose0 := 0
+	keys := make([]mxmlKeyChange, 0) // changes after the first measure
+	staffFor := func(n int) *mxmlStaff {
+		if n == 0 {
+			n = 1
+		}
+		if staves[n] == nil {
+			staves[n] = &mxmlStaff{key: key0, mode: mode0, transpose: transpose0, tied: make(map[mxmlTieKey]*score.Note), voices: make(map[int]uint8)}
+		}
+		return staves[n]
+	}
+	divisions := 1
+	ts := score.CommonTime
+	start := new(big.Rat) // beat position of the current measure
+	for m, meas := range part.Measures {
+		cursor, longest := 0, 0 // in divisions, relative to the measure
+		var prev *big.Rat // start of the previous note, for chords
+		notes := make([]*score.Note, 0) // this measure's notes, positioned relative to the measure
+		noteStaff := make(map[*score.Note]*mxmlStaff)
+		newSig := false
+		for _, el := range meas.Elems {
+			switch el.XMLName.Local {
+			case "attributes":
+				if el.Divisions > 0 {
+					divisions = el.Divisions
+				}
+				if el.Key != nil {
+					key := score.KeySig(el.Key.Fifths)
+					mode, _ := score.ModeNamed(el.Key.Mode)
+					if m == 0 {
+						key0, mode0 = key, mode
+						for _, st := range staves {
+							st.key, st.mode = key, mode
+						}
+					} else {
+						/* a change part way through the measure applies from where it's written */
+						pos := quartersToBeats(big.NewRat(int64(cursor), int64(divisions)), ts)
+						keys = append(keys, mxmlKeyChange{pos.Add(pos, start), key, mode})
+					}
+				}
+				if el.Time != nil {
+					if beats, err := strconv.Atoi(el.Time.Beats); err == nil && beats > 0 && el.Time.Unit > 0 {
+						ts = score.TimeSig{Beats: beats, Unit: el.Time.Unit}
+						newSig = true
+					}
+				}
+				for _, c := range el.Clefs {
+					st := staffFor(c.Number)
+					if c.Sign == "percussion" {
+						st.clef = &score.PercussionClef
+					} else {
+						st.clef = mxmlClefs[c.Sign + strconv.Itoa(c.Line)]
+					}
+				}
+				for _, t := range el.Transposes {
+					semitones := score.ClampTransposition(t.Chromatic + 12 * t.OctaveChange)
+					if t.Number == 0 {
+						transpose0 = semitones
+						for _, st := range staves {
+							st.transpose = semitones
+						}
+					} else {
+						staffFor(t.Number).transpose = semitones
+					}
+				}
+			case "backup":
+				cursor -= el.Duration
+			case "forward":
+				cursor += el.Duration
+			case "note":
+				if el.Grace != nil {
+					continue
+				}
+				pos := big.NewRat(int64(cursor), int64(divisions))
+				if el.Chord != nil && prev != nil {
+					pos = prev
+				} else {
+					cursor += el.Duration
+				}
+				prev = pos
+				if cursor > longest {
+					longest = cursor
+				}
+				st := staffFor(el.Staff)
+				var pitch uint8
+				if el.Unpitched != nil {
+					/* percussion; the display position picks the drum */
+					display := mxmlPitchIn{el.Unpitched.Step, 0, el.Unpitched.Octave}
+					natural, err := display.midi()
+					if err != nil {
+						return nil, fmt.Errorf("measure %d: %v", m + 1, err)
+					}
+					pitch = score.DrumForDisplay(natural).Key
+					if el.Instrument != nil {
+						if key, ok := drums[el.Instrument.Id]; ok {
+							pitch = key
+						}
+					}
+					if st.clef == nil {
+						st.clef = &score.PercussionClef
+					}
+				} else if el.Pitch != nil {
+					var err error
+					pitch, err = el.Pitch.midi()
+					if err != nil {
+						return nil, fmt.Errorf("measure %d: %v", m + 1, err)
+					}
+					altered := int(pitch) + el.Pitch.Alter
+					if altered < 0 || altered > 127 {
+						return nil, fmt.Errorf("measure %d: %s%d altered by %d is out of range", m + 1, el.Pitch.Step, el.Pitch.Octave, el.Pitch.Alter)
+					}
+					pitch = uint8(altered)
+				} else if el.Rest == nil {
+					continue
+				}
+				dur := big.NewRat(int64(el.Duration), int64(divisions))
+				note := &score.Note{Pitch: pitch, Duration: dur, Offset: pos, Voice: st.voice(el.Voice), Rest: el.Rest != nil}
+				if note.Rest {
+					notes = append(notes, note)
+					noteStaff[note] = st
+					continue
+				}
+				stop, startTie := false, false
+				for _, tie := range el.Ties {
+					stop = stop || tie.Type == "stop"
+					startTie = startTie || tie.Type == "start"
+				}
+				key := mxmlTieKey{note.Voice, pitch}
+				if tied, ok := st.tied[key]; ok && stop {
+					/* continuation of an earlier note; just lengthen it */
+					if _, thisMeasure := noteStaff[tied]; thisMeasure {
+						tied.Duration.Add(tied.Duration, dur) // not yet converted to beats
+					} else {
+						tied.Duration.Add(tied.Duration, quartersToBeats(dur, ts))
+					}
+					if !startTie {
+						delete(st.tied, key)
+					}
+					continue
+				}
+				notes = append(notes, note)
+				noteStaff[note] = st
+				if startTie {
+					st.tied[key] = note
+				}
+			}
+		}
+		/* now that the measure's length is known, place the notes on the beats. A pickup
+		 * measure is shifted so that it ends on a whole beat. */
+		length := big.NewRat(int64(ts.Beats), 1)
+		if meas.Implicit == "yes" || longest > divisions * 4 * ts.Beats / ts.Unit {
+			length = quartersToBeats(big.NewRat(int64(longest), int64(divisions)), ts)
+		}
+		if m == 0 && meas.Implicit == "yes" && !length.IsInt() {
+			ceil := new(big.Int).Quo(length.Num(), length.Denom())
+			ceil.Add(ceil, big.NewInt(1))
+			start.Sub(new(big.Rat).SetInt(ceil), length)
+		}
+		for _, note := range notes {
+			pos := quartersToBeats(note.Offset, ts)
+			pos.Add(pos, start)
+			note.Beat, note.Offset = locate(pos)
+			note.Duration = quartersToBeats(note.Duration, ts)
+			st := noteStaff[note]
+			st.notes = append(st.notes, note)
+			if !note.Rest {
+				st.pitchSum += int(note.Pitch)
+				st.npitched++
+			}
+		}
+		if newSig && meas.Implicit != "yes" && start.IsInt() {
+			sigs[int(start.Num().Int64())] = ts
+		}
+		start.Add(start, length)
+		if newSig && meas.Implicit == "yes" && start.IsInt() {
+			sigs[int(start.Num().Int64())] = ts // the meter starts with the first full measure
+		}
+	}
+	for _, st := range staves {
+		st.keys = keys
+	}
+	return staves, nil
+}
+
+/* converts a length in quarter notes to beats of the given time signature */
+func quartersToBeats(quarters *big.Rat, ts score.TimeSig) *big.Rat {
+	return new(big.Rat).Mul(quarters, big.NewRat(int64(ts.Unit), 4))
+}
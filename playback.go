@@ -31,6 +31,9 @@ type MidiOff struct {
 type MidiEv struct {
 	Start FrameN
 	Mix *StaffMix
+	Drums bool // played on the percussion channel rather than Mix.Voice
+	Velocity uint8 // the note's own velocity, 0 for the staff's
+	Dynamic float64 // how much the dynamics scale the velocity
 	Off MidiOff
 	Next *MidiEv
 }
@@ -42,9 +45,23 @@ func midilst(f0, fN, fcur FrameN) (*MidiEv, *MidiEv) {
 	var sn score.StaffNote
 	for next != nil {
 		sn, next = next()
-		start, _ := G.score.ToFrame(G.score.Beatf(sn.Note))
-		end, _ := G.score.ToFrame(G.score.EndBeatf(sn.Note))
-		if end <= f0 {
+		if sn.Note.Rest {
+			continue
+		}
+		start, _ := G.score.ToFrame(sn.Staff.SoundingBeatf(sn.Note))
+		start += sn.Note.Nudge
+		if from := sn.Staff.TiedFrom(sn.Note); from != nil {
+			if f, _ := G.score.ToFrame(sn.Staff.SoundingBeatf(from)); f + from.Nudge >= f0 {
+				continue // already sounding
+			}
+		}
+		/* a tied note is held through to the end of the last note it's tied to */
+		end, _ := G.score.ToFrame(sn.Staff.SoundingEndBeatf(sn.Staff.LastTied(sn.Note)))
+		artic := sn.Note.Articulations
+		if scale := artic.LengthScale(); scale != 1 {
+			end = start + FrameN(float64(end - start) * scale)
+		}
+		if end <= f0 || end <= start {
 			continue
 		} else if start > fN {
 			break
@@ -57,7 +74,9 @@ func midilst(f0, fN, fcur FrameN) (*MidiEv, *MidiEv) {
 		}
 
 		mix := Mixer.For(sn.Staff)
-		*evtail = &MidiEv{start, mix, MidiOff{end, sn.Note.Pitch, 255}, nil}
+		drums := sn.Staff.Clef().IsPercussion()
+		dynamic := sn.Staff.DynamicScale(G.score.Beatf(sn.Note)) * artic.VelocityScale()
+		*evtail = &MidiEv{start, mix, drums, sn.Note.Velocity, dynamic, MidiOff{end, sn.Note.Pitch, 255}, nil}
 		if start >= fcur && evcur == nil {
 			evcur = *evtail
 		}
@@ -66,6 +85,22 @@ func midilst(f0, fN, fcur FrameN) (*MidiEv, *MidiEv) {
 	return evhead, evcur
 }
 
+/* velocity returns the midi velocity of a note at 'vel' (or the staff's velocity, if 0)
+ * scaled by 'dynamic' */
+func velocity(mix *StaffMix, vel uint8, dynamic float64) uint8 {
+	v := float64(mix.Velocity)
+	if vel != 0 {
+		v = float64(vel)
+	}
+	v = math.Floor(v * dynamic + 0.5)
+	if v > 127 {
+		return 127
+	} else if v < 1 {
+		return 1
+	}
+	return uint8(v)
+}
+
 func beatlst(f0, fN, fcur FrameN) (*BeatEv, *BeatEv) {
 	var bcur, bhead *BeatEv
 	btail := &bhead
@@ -302,8 +337,12 @@ func play(rng TimeRange, startPos FrameN, loop bool) {
 			/* user placed notes */
 			for mev != nil && mev.Start < cutoff {
 				if !mev.Mix.Muted {
-					mev.Off.Chan = Synth.Inst(uint8(mev.Mix.Voice))
-					Synth.NoteOn(mev.Off.Chan, mev.Off.Pitch, uint8(mev.Mix.Velocity))
+					inst := uint8(mev.Mix.Voice)
+					if mev.Drums {
+						inst = midi.InstDrums
+					}
+					mev.Off.Chan = Synth.Inst(inst)
+					Synth.NoteOn(mev.Off.Chan, mev.Off.Pitch, velocity(mev.Mix, mev.Velocity, mev.Dynamic))
 					offlist = append(offlist, mev.Off)
 				}
 				mev = mev.Next
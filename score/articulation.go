@@ -0,0 +1,103 @@
+package score
+
+/* Articulation is a set of marks changing how a note is played */
+type Articulation uint8
+
+const (
+	Staccato Articulation = 1 << iota
+	Accent
+	Tenuto
+	Fermata
+)
+
+/* Articulations lists each mark, in the order they're written */
+var Articulations []Articulation = []Articulation{Staccato, Accent, Tenuto, Fermata}
+
+var articulationNames = map[Articulation]string{
+	Staccato: "staccato",
+	Accent: "accent",
+	Tenuto: "tenuto",
+	Fermata: "fermata",
+}
+
+/* String names a single mark, eg. "staccato" */
+func (a Articulation) String() string {
+	if name, ok := articulationNames[a]; ok {
+		return name
+	}
+	return "?"
+}
+
+/* ParseArticulation is the inverse of Articulation.String */
+func ParseArticulation(s string) (Articulation, bool) {
+	for a, name := range articulationNames {
+		if name == s {
+			return a, true
+		}
+	}
+	return 0, false
+}
+
+/* Has returns true if all of the marks in 'b' are included */
+func (a Articulation) Has(b Articulation) bool {
+	return a & b == b
+}
+
+/* LengthScale returns how much of its written length a note sounds for: a staccato note is
+ * cut short, and one under a fermata held on. */
+func (a Articulation) LengthScale() float64 {
+	scale := 1.0
+	if a.Has(Staccato) {
+		scale *= 0.5
+	}
+	if a.Has(Fermata) {
+		scale *= 1.5
+	}
+	return scale
+}
+
+/* VelocityScale returns how much louder than its neighbours a note is played */
+func (a Articulation) VelocityScale() float64 {
+	if a.Has(Accent) {
+		return 1.25
+	}
+	return 1.0
+}
+
+/* ToggleArticulation marks each of 'notes' with 'a', or if they all have it already
+ * removes it from them. Rests are left alone. */
+func (score *Score) ToggleArticulation(a Articulation, notes... StaffNote) bool {
+	return score.update(&ToggleArticulationOp{a: a, notes: notes})
+}
+
+type ToggleArticulationOp struct {
+	a Articulation
+	notes []StaffNote
+	orig []Articulation
+}
+
+func (op *ToggleArticulationOp) apply(score *Score) interface{} {
+	if len(op.notes) == 0 {
+		return nil
+	}
+	all := true
+	op.orig = make([]Articulation, len(op.notes))
+	for i, sn := range op.notes {
+		op.orig[i] = sn.Note.Articulations
+		all = all && (sn.Note.Rest || sn.Note.Articulations.Has(op.a))
+	}
+	for _, sn := range op.notes {
+		if all {
+			sn.Note.Articulations &^= op.a
+		} else if !sn.Note.Rest {
+			sn.Note.Articulations |= op.a
+		}
+	}
+	return notesChanged(op.notes)
+}
+
+func (op *ToggleArticulationOp) undo(score *Score) {
+	for i, sn := range op.notes {
+		sn.Note.Articulations = op.orig[i]
+	}
+}
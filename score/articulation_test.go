@@ -0,0 +1,32 @@
+package score
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestToggleArticulation(t *testing.T) {
+	staff := MkStaff("", &TrebleClef, 0, Major)
+	a := &Note{Pitch: 60, Duration: big.NewRat(1, 1), Offset: new(big.Rat), Articulations: Staccato}
+	b := &Note{Pitch: 62, Duration: big.NewRat(1, 1), Offset: new(big.Rat)}
+	rest := &Note{Pitch: 64, Duration: big.NewRat(1, 1), Offset: new(big.Rat), Rest: true}
+	notes := []StaffNote{{staff, a}, {staff, b}, {staff, rest}}
+
+	op := &ToggleArticulationOp{a: Staccato, notes: notes}
+	op.apply(nil)
+	if !a.Articulations.Has(Staccato) || !b.Articulations.Has(Staccato) || rest.Articulations != 0 {
+		t.Errorf("expected staccato on both notes but not the rest; got %v %v %v", a.Articulations, b.Articulations, rest.Articulations)
+	}
+	(&ToggleArticulationOp{a: Staccato, notes: notes}).apply(nil)
+	if a.Articulations != 0 || b.Articulations != 0 {
+		t.Errorf("expected staccato removed once every note had it; got %v %v", a.Articulations, b.Articulations)
+	}
+	op.undo(nil)
+	if a.Articulations != Staccato || b.Articulations != 0 {
+		t.Errorf("undo should restore the original marks; got %v %v", a.Articulations, b.Articulations)
+	}
+
+	if s := (Staccato | Fermata).LengthScale(); s != 0.75 {
+		t.Errorf("staccato under a fermata should sound for 3/4 of its length; got %v", s)
+	}
+}
@@ -1,6 +1,7 @@
 package score
 
 import (
+	"fmt"
 	"math"
 	"math/big"
 
@@ -91,7 +92,11 @@ func (beat *BeatRef) FrameAtRat(offset *big.Rat) FrameN {
 func (beat *BeatRef) FrameAt(offset float64) FrameN {
 	next := beat.next
 	if next == nil {
-		return beat.frame
+		if beat.prev == nil || offset == 0 {
+			return beat.frame
+		}
+		/* past the last beat; extrapolate at the tempo of the final beat */
+		return beat.frame + FrameN(offset * float64(beat.frame - beat.prev.frame))
 	}
 	return FrameN(float64(beat.frame) * (1 - offset) + float64(next.frame) * (offset))
 }
@@ -175,21 +180,29 @@ func (op *MvBeatOp) undo(score *Score) {
 
 func (beats *BeatList) ToFrame(pt BeatPoint) (FrameN, bool) {
 	b := pt.Beat()
-	b2 := b.next
 	α := pt.Offsetf()
-	if b2 == nil {
-		// last beat. any point past this is clipped to the beat's frame
-		return b.frame, α < 1e-6
+	if b.next == nil && b.prev == nil {
+		// only one beat, so there's no tempo to extrapolate from
+		return b.frame, math.Abs(α) < 1e-6
 	}
-	return FrameN((1 - α) * float64(b.frame) + α * float64(b2.frame)), true
+	return b.FrameAt(α), true
 }
 
-/* returns a fractional beat, and true if it is within the defined beat range */
+/* returns a fractional beat, and true if one could be determined. Frames before the
+ * first beat or after the last are extrapolated at the tempo of the nearest beat,
+ * resulting in an offset outside [0, 1). */
 func (beats *BeatList) ToBeat(frame FrameN) (BeatPoint, bool) {
-	if !beats.HasBeats() || frame < beats.Head.frame || frame > beats.Tail.frame {
-		/* should perhaps extrapolate based on bpm... */
+	if !beats.HasBeats() {
 		return BeatPt{nil, 0.0}, false
 	}
+	if head, tail := beats.Head, beats.Tail; frame < head.frame || frame > tail.frame {
+		if head == tail {
+			return BeatPt{nil, 0.0}, false
+		} else if frame < head.frame {
+			return BeatPt{head, float64(frame - head.frame) / float64(head.next.frame - head.frame)}, true
+		}
+		return BeatPt{tail, float64(frame - tail.frame) / float64(tail.frame - tail.prev.frame)}, true
+	}
 	for b := beats.Head; ; b = b.next {
 		if b.next == nil {
 			return BeatPt{b, 0.0}, true
@@ -230,15 +243,18 @@ func mkBeats(f []FrameN) (beats BeatList) {
 
 func (score *Score) LoadBeats(f []FrameN) {
 	score.BeatList = mkBeats(f)
+	score.meter = nil
 	score.plumb.C <- BeatChanged{}
 }
 
-func (score *Score) AddBeat(frame FrameN) {
-	score.update(&AddBeatOp{frame: frame})
+/* Adds a beat at 'frame', or moves the nearest beat there if it is within 'tolerance'. */
+func (score *Score) AddBeat(frame, tolerance FrameN) {
+	score.update(&AddBeatOp{frame: frame, tolerance: tolerance})
 }
 
 type AddBeatOp struct {
 	frame FrameN
+	tolerance FrameN
 	beat *BeatRef
 	old FrameN
 }
@@ -256,12 +272,11 @@ func (op *AddBeatOp) apply(score *Score) interface{} {
 		score.Tail = op.beat
 		return BeatChanged{}
 	}
-	tolerance := FrameN(10000) //XXX should be based on sample rate/bpm
 	op.beat = score.NearestBeat(op.frame)
 	Δf := op.frame - op.beat.frame
 	if Δf == 0 {
 		return nil
-	} else if Δf < -tolerance || Δf > tolerance {
+	} else if Δf < -op.tolerance || Δf > op.tolerance {
 		if Δf > 0 {
 			op.beat = &BeatRef{op.beat, op.beat.next, op.frame}
 		} else {
@@ -303,34 +318,101 @@ func (beats *BeatList) NearestBeat(frame FrameN) *BeatRef {
 	return nil
 }
 
-// 2 4 8 16 32 64 128
-// 3 6 12 24 48 96
-// 5 10 20 40 80
-// 7 14 28 56 112
+/* Period returns the average number of frames per beat around 'frame', or zero if
+ * there aren't enough beats to tell. */
+func (beats *BeatList) Period(frame FrameN) FrameN {
+	b := beats.NearestBeat(frame)
+	if b == nil || (b.prev == nil && b.next == nil) {
+		return 0
+	}
+	first, last := b.Walk(-2), b.Walk(2)
+	return (last.frame - first.frame) / FrameN(last.Subtract(first))
+}
+
+/* MvBeats moves several beats at once. The beats must stay in order. */
+func (score *Score) MvBeats(moves map[*BeatRef]FrameN) bool {
+	return score.update(&MvBeatsOp{moves, make(map[*BeatRef]FrameN)})
+}
+
+type MvBeatsOp struct {
+	moves map[*BeatRef]FrameN
+	orig map[*BeatRef]FrameN
+}
+
+func (op *MvBeatsOp) apply(score *Score) interface{} {
+	for beat, frame := range op.moves {
+		if beat.frame != frame {
+			op.orig[beat] = beat.frame
+			beat.frame = frame
+		}
+	}
+	if len(op.orig) == 0 {
+		return nil
+	}
+	return BeatChanged{}
+}
+
+func (op *MvBeatsOp) undo(score *Score) {
+	for beat, orig_frame := range op.orig {
+		beat.frame = orig_frame
+		delete(op.orig, beat)
+	}
+}
+
+/* Quantize returns the position on the default grid nearest to 'beat' */
 func (score *Score) Quantize(beat BeatPoint) (*BeatRef, *big.Rat) {
-	best := big.NewRat(0, 1)
-	frac := beat.Offsetf()
-	minErr := frac
-	for _, i := range([]int{2, 3}) { // , 5}) { //, 7}) {
-		for denom := int64(i); denom <= 8; denom <<= 1 {
-			for num := int64(1); num < denom; num++ {
-				r := big.NewRat(num, denom)
-				/* TODO account for picked beats in error measure */
-				f, _ := r.Float64()
-				d := math.Abs(f - frac)
-				if d < minErr {
-					minErr = d
-					best = r
-				}
-			}
+	return quantizeTo(beat, AutoGrid, nil)
+}
+
+/* extension tracks beats created beyond the first or last beat on behalf of an op.
+ * They are recycled when the op is reapplied, so a redo recreates the same BeatRefs. */
+type extension struct {
+	beats []*BeatRef
+	n int
+}
+
+func (x *extension) beat() *BeatRef {
+	if x.n == len(x.beats) {
+		x.beats = append(x.beats, &BeatRef{})
+	}
+	x.n++
+	return x.beats[x.n - 1]
+}
+
+/* extend normalises a note position which may lie beyond the first or last beat,
+ * creating beats at the local tempo as necessary to bring the offset within [0, 1). */
+func (score *Score) extend(note *Note, x *extension) {
+	one := big.NewRat(1, 1)
+	if note.Beat.next == nil && note.Beat.prev == nil {
+		return // only one beat, so there's no tempo to extrapolate from
+	}
+	for note.Offset.Cmp(one) >= 0 {
+		b := note.Beat
+		if b.next == nil {
+			nb := x.beat()
+			nb.prev, nb.next, nb.frame = b, nil, b.FrameAt(1)
+			score.Link(nb)
 		}
+		note.Beat = b.next
+		note.Offset.Sub(note.Offset, one)
 	}
-	b := beat.Beat()
-	if 1 - frac < minErr {
-		b = b.LNext()
-		best = big.NewRat(0, 1)
+	for note.Offset.Sign() < 0 {
+		b := note.Beat
+		if b.prev == nil {
+			nb := x.beat()
+			nb.prev, nb.next, nb.frame = nil, b, b.FrameAt(-1)
+			score.Link(nb)
+		}
+		note.Beat = b.prev
+		note.Offset.Add(note.Offset, one)
+	}
+}
+
+/* removes the beats created by extend, most recent first */
+func (score *Score) unextend(x *extension) {
+	for ; x.n > 0; x.n-- {
+		score.Unlink(x.beats[x.n - 1])
 	}
-	return b, best
 }
 
 type QuantizeBeats struct {
@@ -450,3 +532,142 @@ func (score *Score) QuantizeBeats() {
 	score.quantApply <- c
 	<-c
 }
+
+/* splice replaces whatever beats lie between lo and hi (exclusive) with 'chain'.
+ * lo == nil refers to the start of the list, hi == nil to the end. */
+func (l *BeatList) splice(lo, hi *BeatRef, chain []*BeatRef) {
+	prev := lo
+	for _, b := range chain {
+		b.prev = prev
+		if prev == nil {
+			l.Head = b
+		} else {
+			prev.next = b
+		}
+		prev = b
+	}
+	if prev == nil {
+		l.Head = hi
+	} else {
+		prev.next = hi
+	}
+	if hi == nil {
+		l.Tail = prev
+	} else {
+		hi.prev = prev
+	}
+}
+
+/* ReplaceBeats swaps the beats in the frame range [min, max] for new ones at 'frames',
+ * which must be sorted. Existing beats are reused in order so notes stay attached to
+ * the same beat of the range; it is an error if notes are attached to a beat that
+ * would be removed. */
+func (score *Score) ReplaceBeats(min, max FrameN, frames []FrameN) error {
+	op := &ReplaceBeatsOp{min: min, max: max, frames: frames}
+	score.update(op)
+	return op.err
+}
+
+type ReplaceBeatsOp struct {
+	min, max FrameN
+	frames []FrameN
+	lo, hi *BeatRef // neighbours of the replaced range
+	old []*BeatRef
+	oldFrames []FrameN
+	added []*BeatRef // kept so that a redo recreates the same beats
+	meter []*TimeSigChange
+	keys map[*Staff][]*KeySigChange
+	dynamics map[*Staff][]*DynamicMark
+	err error
+}
+
+func (op *ReplaceBeatsOp) apply(score *Score) interface{} {
+	op.lo, op.hi = nil, score.Head
+	for op.hi != nil && op.hi.frame < op.min {
+		op.lo, op.hi = op.hi, op.hi.next
+	}
+	op.old, op.oldFrames, op.meter, op.keys, op.dynamics = nil, nil, nil, nil, nil
+	for op.hi != nil && op.hi.frame <= op.max {
+		op.old = append(op.old, op.hi)
+		op.oldFrames = append(op.oldFrames, op.hi.frame)
+		op.hi = op.hi.next
+	}
+	if len(op.frames) < len(op.old) {
+		surplus := make(map[*BeatRef]bool)
+		for _, b := range op.old[len(op.frames):] {
+			surplus[b] = true
+		}
+		n := 0
+		for _, staff := range score.staves {
+			for _, note := range staff.notes {
+				if surplus[note.Beat] {
+					n++
+				}
+			}
+		}
+		if n > 0 {
+			op.err = fmt.Errorf("%d notes are attached to beats which would be removed", n)
+			return nil
+		}
+		op.meter = score.meter
+		meter := make([]*TimeSigChange, 0, len(score.meter))
+		for _, tc := range score.meter {
+			if !surplus[tc.Beat] {
+				meter = append(meter, tc)
+			}
+		}
+		score.meter = meter
+		op.keys = make(map[*Staff][]*KeySigChange)
+		for _, staff := range score.staves {
+			op.keys[staff] = staff.keys
+			keys := make([]*KeySigChange, 0, len(staff.keys))
+			for _, kc := range staff.keys {
+				if !surplus[kc.Beat] {
+					keys = append(keys, kc)
+				}
+			}
+			staff.keys = keys
+		}
+		op.dynamics = make(map[*Staff][]*DynamicMark)
+		for _, staff := range score.staves {
+			op.dynamics[staff] = staff.dynamics
+			dynamics := make([]*DynamicMark, 0, len(staff.dynamics))
+			for _, dm := range staff.dynamics {
+				if !surplus[dm.Beat] && !surplus[dm.End] {
+					dynamics = append(dynamics, dm)
+				}
+			}
+			staff.dynamics = dynamics
+		}
+	}
+	chain := make([]*BeatRef, len(op.frames))
+	for i, f := range op.frames {
+		if i < len(op.old) {
+			chain[i] = op.old[i]
+		} else if j := i - len(op.old); j < len(op.added) {
+			chain[i] = op.added[j]
+		} else {
+			chain[i] = &BeatRef{}
+			op.added = append(op.added, chain[i])
+		}
+		chain[i].frame = f
+	}
+	score.splice(op.lo, op.hi, chain)
+	return BeatChanged{}
+}
+
+func (op *ReplaceBeatsOp) undo(score *Score) {
+	for i, b := range op.old {
+		b.frame = op.oldFrames[i]
+	}
+	score.splice(op.lo, op.hi, op.old)
+	if op.meter != nil {
+		score.meter = op.meter
+	}
+	for staff, keys := range op.keys {
+		staff.keys = keys
+	}
+	for staff, dynamics := range op.dynamics {
+		staff.dynamics = dynamics
+	}
+}
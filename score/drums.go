@@ -0,0 +1,156 @@
+package score
+
+/* DrumSound is one of the General MIDI percussion sounds, as written on a percussion staff */
+type DrumSound struct {
+	Key uint8 // note number on the GM percussion channel
+	Name string
+	Line int // position relative to the middle line of the staff
+	Cross bool // written with an x-shaped head, as cymbals are
+}
+
+/* GMDrums maps the lines of a percussion staff to the drum kit. Where several sounds share
+ * a line the first is the one placed there by default. */
+var GMDrums []DrumSound = []DrumSound{
+	{44, "Pedal Hi-Hat", -5, true},
+	{35, "Acoustic Bass Drum", -4, false},
+	{36, "Bass Drum", -3, false},
+	{41, "Low Floor Tom", -2, false},
+	{43, "High Floor Tom", -1, false},
+	{45, "Low Tom", 0, false},
+	{38, "Acoustic Snare", 1, false},
+	{37, "Side Stick", 1, true},
+	{40, "Electric Snare", 1, false},
+	{47, "Low-Mid Tom", 2, false},
+	{48, "Hi-Mid Tom", 2, false},
+	{50, "High Tom", 3, false},
+	{51, "Ride Cymbal", 4, true},
+	{53, "Ride Bell", 4, true},
+	{59, "Ride Cymbal 2", 4, true},
+	{42, "Closed Hi-Hat", 5, true},
+	{46, "Open Hi-Hat", 5, true},
+	{49, "Crash Cymbal", 6, true},
+	{55, "Splash Cymbal", 6, true},
+	{57, "Crash Cymbal 2", 7, true},
+	{52, "Chinese Cymbal", 7, true},
+}
+
+/* DrumForLine returns the default sound for a line of a percussion staff. Lines beyond the
+ * kit take the sound of the nearest line that has one. */
+func DrumForLine(line int) DrumSound {
+	lo, hi := GMDrums[0].Line, GMDrums[0].Line
+	for _, d := range GMDrums {
+		if d.Line < lo {
+			lo = d.Line
+		}
+		if d.Line > hi {
+			hi = d.Line
+		}
+	}
+	if line < lo {
+		line = lo
+	} else if line > hi {
+		line = hi
+	}
+	for _, d := range GMDrums {
+		if d.Line == line {
+			return d
+		}
+	}
+	return GMDrums[0]
+}
+
+/* FindDrum looks up the sound with GM note number 'key' */
+func FindDrum(key uint8) (DrumSound, bool) {
+	for _, d := range GMDrums {
+		if d.Key == key {
+			return d, true
+		}
+	}
+	return DrumSound{}, false
+}
+
+/* spellDrum places a percussion note on its line. Sounds outside the kit sit on the middle
+ * line. */
+func spellDrum(clef *Clef, key uint8) Spelled {
+	d, _ := FindDrum(key)
+	natural, tone := clef.naturalForLine(d.Line)
+	return Spelled{d.Line, 0, false, key, tone, natural}
+}
+
+/* DrumForDisplay returns the default sound for the line of a percussion staff which the
+ * natural pitch 'display' would sit on in the treble clef */
+func DrumForDisplay(display uint8) DrumSound {
+	tone := degree2scale[display % 12]
+	if tone == -1 {
+		display, tone = display - 1, degree2scale[(display - 1) % 12]
+	}
+	return DrumForLine(lineForTone(&PercussionClef, tone, int(display)))
+}
+
+/* CycleDrums changes each of 'notes' on a percussion staff to the next sound written on
+ * the same line, eg. a closed hi-hat to an open one. */
+func (score *Score) CycleDrums(notes... StaffNote) bool {
+	return score.update(&CycleDrumsOp{notes: notes})
+}
+
+type CycleDrumsOp struct {
+	notes []StaffNote
+	orig []uint8
+}
+
+func (op *CycleDrumsOp) apply(score *Score) interface{} {
+	op.orig = make([]uint8, len(op.notes))
+	changed := false
+	/* pitch affects the order of notes, so take them out while changing it */
+	for i, sn := range op.notes {
+		op.orig[i] = sn.Note.Pitch
+		if !sn.Staff.clef.drums || sn.Note.Rest {
+			continue
+		}
+		sn.Staff.removeNote(sn.Note)
+		sn.Note.Pitch = nextDrum(sn.Note.Pitch)
+		changed = changed || sn.Note.Pitch != op.orig[i]
+	}
+	for _, sn := range op.notes {
+		if sn.Staff.clef.drums && !sn.Note.Rest {
+			sn.Staff.addNote(sn.Note)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return notesChanged(op.notes)
+}
+
+func (op *CycleDrumsOp) undo(score *Score) {
+	for i, sn := range op.notes {
+		if sn.Note.Pitch != op.orig[i] {
+			sn.Staff.removeNote(sn.Note)
+		}
+	}
+	for i, sn := range op.notes {
+		if sn.Note.Pitch != op.orig[i] {
+			sn.Note.Pitch = op.orig[i]
+			sn.Staff.addNote(sn.Note)
+		}
+	}
+}
+
+/* nextDrum returns the sound after 'key' among those sharing its line */
+func nextDrum(key uint8) uint8 {
+	d, ok := FindDrum(key)
+	if !ok {
+		return DrumForLine(0).Key
+	}
+	line := make([]uint8, 0, 3)
+	at := 0
+	for _, d2 := range GMDrums {
+		if d2.Line == d.Line {
+			if d2.Key == key {
+				at = len(line)
+			}
+			line = append(line, d2.Key)
+		}
+	}
+	return line[(at + 1) % len(line)]
+}
@@ -0,0 +1,219 @@
+package score
+
+import (
+	"sort"
+)
+
+/* Dynamic is a loudness marking, from pianissimo to fortissimo */
+type Dynamic int
+
+const (
+	NoDynamic Dynamic = iota
+	PP
+	P
+	MP
+	MF
+	F
+	FF
+)
+
+var dynamicNames = []string{"", "pp", "p", "mp", "mf", "f", "ff"}
+
+/* the nominal midi velocity of each dynamic */
+var dynamicVelocities = []float64{0, 36, 52, 68, 84, 100, 116}
+
+func (d Dynamic) String() string {
+	if d < NoDynamic || d > FF {
+		return "?"
+	}
+	return dynamicNames[d]
+}
+
+/* ParseDynamic is the inverse of Dynamic.String */
+func ParseDynamic(s string) (Dynamic, bool) {
+	for i, name := range dynamicNames {
+		if name == s {
+			return Dynamic(i), true
+		}
+	}
+	return NoDynamic, false
+}
+
+/* Scale returns how much the dynamic scales a velocity relative to mezzo-forte, which
+ * leaves it alone */
+func (d Dynamic) Scale() float64 {
+	if d <= NoDynamic || d > FF {
+		return 1.0
+	}
+	return dynamicVelocities[d] / dynamicVelocities[MF]
+}
+
+/* hairpinStep is how much a hairpin which doesn't end at a dynamic changes the scale */
+const hairpinStep = 1.25
+
+/* DynamicMark is a dynamic, a hairpin or both, anchored at a beat of a staff. A hairpin
+ * runs from Beat to End, finishing at the dynamic marked at End if there is one. */
+type DynamicMark struct {
+	Beat *BeatRef
+	Level Dynamic // NoDynamic for a hairpin alone
+	Hairpin int // +1 for a crescendo, -1 for a diminuendo, 0 for none
+	End *BeatRef // where the hairpin finishes
+}
+
+func (dm *DynamicMark) empty() bool {
+	return dm.Level == NoDynamic && (dm.Hairpin == 0 || dm.End == nil)
+}
+
+/* Dynamics returns the dynamic marks of the staff, in beat order */
+func (staff *Staff) Dynamics() []*DynamicMark {
+	return staff.dynamics
+}
+
+/* DynamicAt returns the mark anchored at 'beat', or nil if there isn't one */
+func (staff *Staff) DynamicAt(beat *BeatRef) *DynamicMark {
+	for _, dm := range staff.dynamics {
+		if dm.Beat == beat {
+			return dm
+		}
+	}
+	return nil
+}
+
+/* DynamicScale returns how much the dynamics in effect at 'pt' scale the staff's velocity,
+ * following any hairpin smoothly from one dynamic to the next. */
+func (staff *Staff) DynamicScale(pt BeatPoint) float64 {
+	f := pt.Beat().FrameAt(pt.Offsetf())
+	scale := 1.0
+	for _, dm := range staff.dynamics {
+		if dm.Beat.frame > f {
+			break
+		}
+		if dm.Level != NoDynamic {
+			scale = dm.Level.Scale()
+		}
+		if dm.Hairpin == 0 || dm.End == nil {
+			continue
+		}
+		to := staff.hairpinTarget(dm, scale)
+		if dm.End.frame > f && dm.End.frame > dm.Beat.frame {
+			α := float64(f - dm.Beat.frame) / float64(dm.End.frame - dm.Beat.frame)
+			return scale + α * (to - scale)
+		}
+		scale = to
+	}
+	return scale
+}
+
+func (staff *Staff) hairpinTarget(dm *DynamicMark, from float64) float64 {
+	if end := staff.DynamicAt(dm.End); end != nil && end.Level != NoDynamic {
+		return end.Level.Scale()
+	}
+	if dm.Hairpin > 0 {
+		return from * hairpinStep
+	}
+	return from / hairpinStep
+}
+
+type dynamicList []*DynamicMark
+
+func (l dynamicList) Len() int { return len(l) }
+func (l dynamicList) Less(i, j int) bool { return l[i].Beat.frame < l[j].Beat.frame }
+func (l dynamicList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+/* LoadDynamics replaces the dynamic marks of a staff which hasn't been added to the score
+ * yet. Keys index into the beat list, as do the values of 'ends', which give the end of
+ * the hairpin starting at each key. */
+func (score *Score) LoadDynamics(staff *Staff, marks map[int]DynamicMark, ends map[int]int) {
+	beats := make(map[int]*BeatRef)
+	i := 0
+	for b := score.Head; b != nil; b = b.next {
+		beats[i] = b
+		i++
+	}
+	dynamics := make([]*DynamicMark, 0, len(marks))
+	for i, dm := range marks {
+		if beats[i] == nil {
+			continue
+		}
+		mark := &DynamicMark{beats[i], dm.Level, dm.Hairpin, nil}
+		if end, ok := ends[i]; ok && end > i {
+			mark.End = beats[end]
+		}
+		if !mark.empty() {
+			dynamics = append(dynamics, mark)
+		}
+	}
+	sort.Sort(dynamicList(dynamics))
+	staff.dynamics = dynamics
+}
+
+/* SetDynamic replaces the mark anchored at 'mark.Beat' on 'staff' with 'mark', or removes
+ * it if 'mark' has neither a dynamic nor a hairpin. */
+func (score *Score) SetDynamic(staff *Staff, mark DynamicMark) bool {
+	return score.update(&SetDynamicOp{staff: staff, mark: mark})
+}
+
+type SetDynamicOp struct {
+	staff *Staff
+	mark DynamicMark
+	orig []*DynamicMark
+}
+
+func (op *SetDynamicOp) apply(score *Score) interface{} {
+	op.orig = op.staff.dynamics
+	if existing := op.staff.DynamicAt(op.mark.Beat); existing != nil && *existing == op.mark {
+		return nil
+	} else if existing == nil && op.mark.empty() {
+		return nil
+	}
+	/* build a new slice rather than modify in place; readers don't synchronise with us */
+	dynamics := make([]*DynamicMark, 0, len(op.staff.dynamics) + 1)
+	for _, dm := range op.staff.dynamics {
+		if dm.Beat != op.mark.Beat {
+			dynamics = append(dynamics, dm)
+		}
+	}
+	if !op.mark.empty() {
+		mark := op.mark
+		dynamics = append(dynamics, &mark)
+		sort.Sort(dynamicList(dynamics))
+	}
+	op.staff.dynamics = dynamics
+	return staffChanged(op.staff)
+}
+
+func (op *SetDynamicOp) undo(score *Score) {
+	op.staff.dynamics = op.orig
+}
+
+/* SetVelocity sets the velocity of each of 'notes'. A velocity of 0 plays the note at the
+ * velocity of its staff. */
+func (score *Score) SetVelocity(velocities []uint8, notes... StaffNote) bool {
+	return score.update(&SetVelocityOp{velocities: velocities, notes: notes})
+}
+
+type SetVelocityOp struct {
+	velocities []uint8
+	notes []StaffNote
+	orig []uint8
+}
+
+func (op *SetVelocityOp) apply(score *Score) interface{} {
+	op.orig = make([]uint8, len(op.notes))
+	changed := false
+	for i, sn := range op.notes {
+		op.orig[i] = sn.Note.Velocity
+		changed = changed || sn.Note.Velocity != op.velocities[i]
+		sn.Note.Velocity = op.velocities[i]
+	}
+	if !changed {
+		return nil
+	}
+	return notesChanged(op.notes)
+}
+
+func (op *SetVelocityOp) undo(score *Score) {
+	for i, sn := range op.notes {
+		sn.Note.Velocity = op.orig[i]
+	}
+}
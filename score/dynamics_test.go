@@ -0,0 +1,36 @@
+package score
+
+import (
+	"math"
+	"testing"
+
+	. "github.com/sqweek/sqribe/core/types"
+)
+
+func TestDynamicScale(t *testing.T) {
+	score := Score{BeatList: mkBeats([]FrameN{0, 100, 200, 300, 400, 500})}
+	beats := make([]*BeatRef, 0, 6)
+	for b := score.Head; b != nil; b = b.next {
+		beats = append(beats, b)
+	}
+	staff := MkStaff("", &TrebleClef, 0, Major)
+	score.LoadDynamics(staff, map[int]DynamicMark{1: {Level: P, Hairpin: 1}, 3: {Level: F}, 4: {Hairpin: -1}}, map[int]int{1: 3, 4: 5})
+
+	cases := []struct {
+		beat int
+		offset float64
+		expected float64
+	}{
+		{0, 0.5, 1}, // nothing marked yet
+		{1, 0, P.Scale()},
+		{2, 0, (P.Scale() + F.Scale()) / 2},
+		{3, 0.5, F.Scale()},
+		{4, 0.5, F.Scale() * (1 + 1 / hairpinStep) / 2},
+		{5, 0, F.Scale() / hairpinStep},
+	}
+	for _, c := range cases {
+		if s := staff.DynamicScale(BeatPt{beats[c.beat], c.offset}); math.Abs(s - c.expected) > 1e-9 {
+			t.Errorf("scale at %d+%v is %v; expected %v", c.beat, c.offset, s, c.expected)
+		}
+	}
+}
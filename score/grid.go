@@ -0,0 +1,224 @@
+package score
+
+import (
+	"math"
+	"math/big"
+	"sort"
+)
+
+/* Grid is the set of positions within a beat which notes are quantized to */
+type Grid struct {
+	Name string
+	points []*big.Rat // in (0, 1)
+}
+
+func mkGrid(name string, denoms... int64) *Grid {
+	g := &Grid{Name: name}
+	seen := make(map[string]bool)
+	for _, denom := range denoms {
+		for num := int64(1); num < denom; num++ {
+			r := big.NewRat(num, denom)
+			if !seen[r.RatString()] {
+				seen[r.RatString()] = true
+				g.points = append(g.points, r)
+			}
+		}
+	}
+	return g
+}
+
+var (
+	AutoGrid = mkGrid("Auto", 2, 4, 8, 3, 6)
+	SixteenthGrid = mkGrid("16ths", 2, 4)
+	TripletGrid = mkGrid("Triplets", 3, 6)
+	ThirtySecondGrid = mkGrid("32nds", 2, 4, 8)
+	QuintupletGrid = mkGrid("Quintuplets", 5)
+	/* swung eighths are written as the last note of a triplet */
+	SwingGrid = &Grid{"Swing", []*big.Rat{big.NewRat(2, 3)}}
+)
+
+var Grids []*Grid = []*Grid{AutoGrid, SixteenthGrid, TripletGrid, ThirtySecondGrid, QuintupletGrid, SwingGrid}
+
+/* GridNamed returns the grid called 'name', or nil if there is no such grid */
+func GridNamed(name string) *Grid {
+	for _, g := range Grids {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+/* usedBias scales the error of positions already used by nearby notes, so that a note
+ * played slightly off the beat lines up with its neighbours rather than a finer position */
+const usedBias = 0.5
+
+/* quantize returns the grid position nearest 'frac', in [0, 1] */
+func (g *Grid) quantize(frac float64, used map[string]bool) *big.Rat {
+	best := big.NewRat(0, 1)
+	minErr := frac
+	if used[best.RatString()] {
+		minErr *= usedBias
+	}
+	for _, r := range g.points {
+		f, _ := r.Float64()
+		d := math.Abs(f - frac)
+		if used[r.RatString()] {
+			d *= usedBias
+		}
+		if d < minErr {
+			minErr = d
+			best = r
+		}
+	}
+	if d := 1 - frac; d < minErr || (used["0"] && d * usedBias < minErr) {
+		best = big.NewRat(1, 1)
+	}
+	return new(big.Rat).Set(best)
+}
+
+/* Grid returns the grid notes are quantized to on the staff */
+func (staff *Staff) Grid() *Grid {
+	if staff.grid == nil {
+		return AutoGrid
+	}
+	return staff.grid
+}
+
+/* LoadGrid sets the grid of a staff which hasn't been added to the score yet */
+func (score *Score) LoadGrid(staff *Staff, grid *Grid) {
+	staff.grid = grid
+}
+
+/* offsetsNear returns the offsets of notes on the staff within 'n' beats of 'beat' */
+func (staff *Staff) offsetsNear(beat *BeatRef, n int) map[string]bool {
+	lo, hi := beat, beat
+	for i := 0; i < n; i++ {
+		if lo.prev != nil {
+			lo = lo.prev
+		}
+		if hi.next != nil {
+			hi = hi.next
+		}
+	}
+	used := make(map[string]bool)
+	notes := staff.notes
+	i := sort.Search(len(notes), func(i int)bool { return notes[i].Beat.frame >= lo.frame })
+	for ; i < len(notes) && notes[i].Beat.frame <= hi.frame; i++ {
+		used[notes[i].Offset.RatString()] = true
+	}
+	return used
+}
+
+/* QuantizeOn is like Quantize, but uses the grid of 'staff' and favours the positions
+ * already used by notes in the beats around 'beat' */
+func (score *Score) QuantizeOn(staff *Staff, beat BeatPoint) (*BeatRef, *big.Rat) {
+	if staff == nil {
+		return score.Quantize(beat)
+	}
+	return quantizeTo(beat, staff.Grid(), staff.offsetsNear(beat.Beat(), 1))
+}
+
+func quantizeTo(beat BeatPoint, grid *Grid, used map[string]bool) (*BeatRef, *big.Rat) {
+	/* points beyond the first or last beat have offsets outside [0, 1) */
+	whole := math.Floor(beat.Offsetf())
+	best := grid.quantize(beat.Offsetf() - whole, used)
+	b := beat.Beat()
+	if whole != 0 {
+		best.Add(best, big.NewRat(int64(whole), 1))
+	} else if best.Cmp(big.NewRat(1, 1)) == 0 && b.next != nil {
+		b, best = b.next, big.NewRat(0, 1)
+	}
+	return b, best
+}
+
+/* SetGrid changes the grid of 'staves' to 'grid', and moves 'notes' to the nearest
+ * positions on the new grid */
+func (score *Score) SetGrid(grid *Grid, staves []*Staff, notes... StaffNote) bool {
+	return score.update(&SetGridOp{grid: grid, staves: staves, notes: notes})
+}
+
+type SetGridOp struct {
+	grid *Grid
+	staves []*Staff
+	notes []StaffNote
+	origGrid []*Grid
+	orig []notePos
+	origDur []big.Rat
+}
+
+func (op *SetGridOp) apply(score *Score) interface{} {
+	changed := make([]*Staff, 0, len(op.staves) + len(op.notes))
+	op.origGrid = make([]*Grid, len(op.staves))
+	for i, staff := range op.staves {
+		op.origGrid[i] = staff.grid
+		if staff.Grid() != op.grid {
+			staff.grid = op.grid
+			changed = append(changed, staff)
+		}
+	}
+	op.orig = make([]notePos, len(op.notes))
+	op.origDur = make([]big.Rat, len(op.notes))
+	moved := make([]bool, len(op.notes))
+	/* position affects the order of notes, so take them out while moving them */
+	for i, sn := range op.notes {
+		op.orig[i] = posOf(sn.Note)
+		op.origDur[i].Set(sn.Note.Duration)
+		beat, offset, dur := requantize(sn.Note, sn.Staff.Grid())
+		if beat == sn.Note.Beat && offset.Cmp(sn.Note.Offset) == 0 && dur.Cmp(sn.Note.Duration) == 0 {
+			continue
+		}
+		moved[i] = true
+		sn.Staff.removeNote(sn.Note)
+		sn.Note.Beat = beat
+		sn.Note.Offset.Set(offset)
+		sn.Note.Duration.Set(dur)
+		changed = append(changed, sn.Staff)
+	}
+	for i, sn := range op.notes {
+		if moved[i] {
+			sn.Staff.addNote(sn.Note)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return staffChanged(changed...)
+}
+
+func (op *SetGridOp) undo(score *Score) {
+	for i, staff := range op.staves {
+		staff.grid = op.origGrid[i]
+	}
+	for _, sn := range op.notes {
+		sn.Staff.removeNote(sn.Note)
+	}
+	for i, sn := range op.notes {
+		op.orig[i].restore(sn.Note)
+		sn.Note.Duration.Set(&op.origDur[i])
+		sn.Staff.addNote(sn.Note)
+	}
+}
+
+/* requantize returns the position and duration of 'note' with both ends moved to the
+ * nearest points of 'grid'. A note never shrinks to nothing. */
+func requantize(note *Note, grid *Grid) (*BeatRef, *big.Rat, *big.Rat) {
+	one := big.NewRat(1, 1)
+	start := new(big.Rat).Set(note.Offset)
+	end := new(big.Rat).Add(note.Offset, note.Duration)
+	for _, r := range []*big.Rat{start, end} {
+		f, _ := r.Float64()
+		whole := math.Floor(f)
+		r.Add(grid.quantize(f - whole, nil), big.NewRat(int64(whole), 1))
+	}
+	dur := new(big.Rat).Sub(end, start)
+	if dur.Sign() <= 0 {
+		dur.Set(note.Duration)
+	}
+	beat := note.Beat
+	for start.Cmp(one) >= 0 && beat.next != nil {
+		beat = beat.next
+		start.Sub(start, one)
+	}
+	return beat, start, dur
+}
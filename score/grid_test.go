@@ -0,0 +1,39 @@
+package score
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestGrid(t *testing.T) {
+	b0 := &BeatRef{frame: 0}
+	b1 := &BeatRef{frame: 100, prev: b0}
+	b0.next = b1
+	cases := []struct {
+		grid *Grid
+		offset float64
+		beat *BeatRef
+		expected string
+	}{
+		{AutoGrid, 0.3, b0, "1/3"},
+		{SixteenthGrid, 0.3, b0, "1/4"},
+		{TripletGrid, 0.45, b0, "1/2"},
+		{QuintupletGrid, 0.45, b0, "2/5"},
+		{SwingGrid, 0.55, b0, "2/3"},
+		{SwingGrid, 0.9, b1, "0"},
+	}
+	for _, c := range cases {
+		beat, offset := quantizeTo(BeatPt{b0, c.offset}, c.grid, nil)
+		if beat != c.beat || offset.RatString() != c.expected {
+			t.Errorf("%s grid put %v at %v; expected %s", c.grid.Name, c.offset, offset, c.expected)
+		}
+	}
+
+	/* a position in use nearby wins over a slightly closer one */
+	staff := MkStaff("", &TrebleClef, 0, Major)
+	staff.addNote(&Note{Pitch: 60, Duration: big.NewRat(1, 4), Beat: b0, Offset: big.NewRat(1, 4)})
+	staff.grid = AutoGrid
+	if _, offset := quantizeTo(BeatPt{b1, 0.3}, staff.Grid(), staff.offsetsNear(b1, 1)); offset.RatString() != "1/4" {
+		t.Errorf("expected a nearby position to be favoured; got %v", offset)
+	}
+}
@@ -0,0 +1,114 @@
+package score
+
+/* Staves are grouped into parts - eg. the treble and bass staves of a piano - by joining
+ * each to the staff above it. A part's staves are therefore always adjacent. */
+
+func (staff *Staff) Joined() bool {
+	return staff.joined
+}
+
+/* Parts returns the score's staves divided into parts, in order */
+func (score *Score) Parts() [][]*Staff {
+	parts := make([][]*Staff, 0, len(score.staves))
+	for i, staff := range score.staves {
+		if i > 0 && staff.joined {
+			parts[len(parts) - 1] = append(parts[len(parts) - 1], staff)
+		} else {
+			parts = append(parts, []*Staff{staff})
+		}
+	}
+	return parts
+}
+
+/* PartOf returns the staves grouped with 'staff' (including itself). A staff which isn't
+ * in the score is a part of its own. */
+func (score *Score) PartOf(staff *Staff) []*Staff {
+	for _, part := range score.Parts() {
+		for _, s := range part {
+			if s == staff {
+				return part
+			}
+		}
+	}
+	return []*Staff{staff}
+}
+
+/* LoadJoined sets whether a staff which hasn't been added to the score yet joins the
+ * staff above it. */
+func (score *Score) LoadJoined(staff *Staff, joined bool) {
+	staff.joined = joined
+}
+
+/* JoinStaff groups 'staff' into the same part as the staff above it, or splits the part
+ * at 'staff' if 'join' is false. */
+func (score *Score) JoinStaff(staff *Staff, join bool) bool {
+	return score.update(&JoinStaffOp{staff: staff, join: join})
+}
+
+type JoinStaffOp struct {
+	staff *Staff
+	join bool
+	orig bool
+}
+
+func (op *JoinStaffOp) apply(score *Score) interface{} {
+	op.orig = op.staff.joined
+	if op.join && (len(score.staves) == 0 || score.staves[0] == op.staff) {
+		return nil // nothing above to join
+	}
+	if op.orig == op.join {
+		return nil
+	}
+	op.staff.joined = op.join
+	return staffChanged(score.staves...)
+}
+
+func (op *JoinStaffOp) undo(score *Score) {
+	op.staff.joined = op.orig
+}
+
+/* CrossStaff moves each of 'notes' onto the staff 'Δstaff' places below its own, so long
+ * as that staff belongs to the same part. Notes keep their pitch. */
+func (score *Score) CrossStaff(Δstaff int, notes... StaffNote) []StaffNote {
+	op := &CrossStaffOp{Δstaff: Δstaff, notes: notes}
+	score.update(op)
+	return op.moved
+}
+
+type CrossStaffOp struct {
+	Δstaff int
+	notes []StaffNote
+	moved []StaffNote // where the notes ended up
+}
+
+func (op *CrossStaffOp) apply(score *Score) interface{} {
+	op.moved = make([]StaffNote, len(op.notes))
+	changed := make([]*Staff, 0, 2 * len(op.notes))
+	for i, sn := range op.notes {
+		op.moved[i] = sn
+		part := score.PartOf(sn.Staff)
+		for j, staff := range part {
+			if staff == sn.Staff && j + op.Δstaff >= 0 && j + op.Δstaff < len(part) {
+				dst := part[j + op.Δstaff]
+				sn.Staff.removeNote(sn.Note)
+				dst.addNote(sn.Note)
+				op.moved[i] = StaffNote{dst, sn.Note}
+				changed = append(changed, sn.Staff, dst)
+				break
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return staffChanged(changed...)
+}
+
+func (op *CrossStaffOp) undo(score *Score) {
+	for i, sn := range op.moved {
+		if sn.Staff != op.notes[i].Staff {
+			sn.Staff.removeNote(sn.Note)
+			op.notes[i].Staff.addNote(sn.Note)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package score
+
+import (
+	"testing"
+)
+
+func TestParts(t *testing.T) {
+	var score Score
+	a := MkStaff("", &TrebleClef, 0, Major)
+	b := MkStaff("", &TrebleClef, 0, Major)
+	c := MkStaff("", &BassClef, 0, Major)
+	d := MkStaff("", &BassClef, 0, Major)
+	score.LoadJoined(a, true) // nothing above, so it starts a part regardless
+	score.LoadJoined(c, true)
+	score.staves = []*Staff{a, b, c, d}
+
+	parts := score.Parts()
+	if len(parts) != 3 || len(parts[0]) != 1 || len(parts[1]) != 2 || len(parts[2]) != 1 {
+		t.Fatalf("expected parts of 1, 2 and 1 staves; got %v", parts)
+	}
+	if part := score.PartOf(c); part[0] != b || part[1] != c {
+		t.Errorf("staff should be grouped with the staff above")
+	}
+	if part := score.PartOf(MkStaff("", &TrebleClef, 0, Major)); len(part) != 1 {
+		t.Errorf("a staff outside the score should be a part of its own")
+	}
+}
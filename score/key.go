@@ -0,0 +1,134 @@
+package score
+
+/* KeySigChange marks a modulation on a staff; the new key takes effect from Beat. */
+type KeySigChange struct {
+	Beat *BeatRef
+	KeySig
+	Mode Mode
+}
+
+/* returns the key in effect at 'beat'. A nil beat refers to the start of the staff. */
+func (staff *Staff) KeyAt(beat *BeatRef) (KeySig, Mode) {
+	key, mode := staff.nsharps, staff.mode
+	if beat == nil {
+		return key, mode
+	}
+	/* changes are kept in beat order */
+	for _, kc := range staff.keys {
+		if kc.Beat.frame > beat.frame {
+			break
+		}
+		key, mode = kc.KeySig, kc.Mode
+	}
+	return key, mode
+}
+
+/* returns the key change anchored at 'beat', or nil if there isn't one */
+func (staff *Staff) KeySigChangeAt(beat *BeatRef) *KeySigChange {
+	for _, kc := range staff.keys {
+		if kc.Beat == beat {
+			return kc
+		}
+	}
+	return nil
+}
+
+func (staff *Staff) KeySigChanges() []*KeySigChange {
+	return staff.keys
+}
+
+/* LoadKeys replaces the key changes of a staff which hasn't been added to the score yet.
+ * Keys index into the beat list. */
+func (score *Score) LoadKeys(staff *Staff, keys map[int]KeySigChange) {
+	changes := make([]*KeySigChange, 0, len(keys))
+	i := 0
+	for b := score.Head; b != nil; b = b.next {
+		if kc, ok := keys[i]; ok {
+			changes = append(changes, &KeySigChange{b, kc.KeySig, kc.Mode})
+		}
+		i++
+	}
+	staff.keys = changes
+}
+
+/* SetKey changes the key of the given staves from 'beat' onwards. A nil beat sets the key
+ * at the start of the staff, otherwise a key change is anchored at 'beat' - unless the key
+ * matches the one already in effect, in which case any existing change there is removed. */
+func (score *Score) SetKey(beat *BeatRef, key KeySig, mode Mode, staves... *Staff) bool {
+	return score.update(&SetKeyOp{beat: beat, key: key, mode: mode, staves: staves})
+}
+
+type SetKeyOp struct {
+	beat *BeatRef
+	key KeySig
+	mode Mode
+	staves []*Staff
+	orig []staffKeys
+}
+
+type staffKeys struct {
+	nsharps KeySig
+	mode Mode
+	keys []*KeySigChange
+}
+
+func (op *SetKeyOp) apply(score *Score) interface{} {
+	op.orig = make([]staffKeys, len(op.staves))
+	changed := make([]*Staff, 0, len(op.staves))
+	for i, staff := range op.staves {
+		op.orig[i] = staffKeys{staff.nsharps, staff.mode, staff.keys}
+		if op.beat == nil {
+			if staff.nsharps != op.key || staff.mode != op.mode {
+				staff.nsharps, staff.mode = op.key, op.mode
+				changed = append(changed, staff)
+			}
+			continue
+		}
+		prevKey, prevMode := staff.KeyAt(op.beat.prev)
+		existing := staff.KeySigChangeAt(op.beat)
+		if existing == nil && prevKey == op.key && prevMode == op.mode {
+			continue
+		} else if existing != nil && existing.KeySig == op.key && existing.Mode == op.mode {
+			continue
+		}
+		insert := prevKey != op.key || prevMode != op.mode
+		/* build a new slice rather than modify in place; readers don't synchronise with us */
+		keys := make([]*KeySigChange, 0, len(staff.keys) + 1)
+		for _, kc := range staff.keys {
+			if insert && kc.Beat.frame > op.beat.frame {
+				keys = append(keys, &KeySigChange{op.beat, op.key, op.mode})
+				insert = false
+			}
+			if kc.Beat != op.beat {
+				keys = append(keys, kc)
+			}
+		}
+		if insert {
+			keys = append(keys, &KeySigChange{op.beat, op.key, op.mode})
+		}
+		staff.keys = keys
+		changed = append(changed, staff)
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return KeyChanged(staffChanged(changed...))
+}
+
+func (op *SetKeyOp) undo(score *Score) {
+	for i, staff := range op.staves {
+		staff.nsharps, staff.mode, staff.keys = op.orig[i].nsharps, op.orig[i].mode, op.orig[i].keys
+	}
+}
+
+/* ShiftKey returns the key 'dsharps' steps around the circle of fifths from 'key'.
+ * Keys with more than seven sharps/flats wrap to their enharmonic equivalent. */
+func ShiftKey(key KeySig, dsharps int) KeySig {
+	key += KeySig(dsharps)
+	if key > 7 {
+		key -= 12
+	} else if key < -7 {
+		key += 12
+	}
+	return key
+}
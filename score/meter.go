@@ -0,0 +1,153 @@
+package score
+
+import (
+	"fmt"
+)
+
+type TimeSig struct {
+	Beats int // number of beats per measure
+	Unit int // note value of a single beat (4 = quarter, 8 = eighth)
+}
+
+var CommonTime = TimeSig{4, 4}
+
+func (ts TimeSig) String() string {
+	return fmt.Sprintf("%d/%d", ts.Beats, ts.Unit)
+}
+
+/* TimeSigChange marks the start of a new meter; a measure always begins at Beat. */
+type TimeSigChange struct {
+	Beat *BeatRef
+	TimeSig
+}
+
+type MeterChanged struct {
+}
+
+/* BarPos locates a beat within the measure structure of the score. */
+type BarPos struct {
+	Bar int // measure number, starting from 1
+	Beat int // index of the beat within its measure, starting from 0
+	TimeSig
+}
+
+func (pos BarPos) IsDownbeat() bool {
+	return pos.Beat == 0
+}
+
+func (pos BarPos) String() string {
+	return fmt.Sprintf("%d:%d", pos.Bar, pos.Beat + 1)
+}
+
+/* returns the time signature change anchored at 'beat', or nil if there isn't one */
+func (score *Score) TimeSigChangeAt(beat *BeatRef) *TimeSigChange {
+	for _, tc := range score.meter {
+		if tc.Beat == beat {
+			return tc
+		}
+	}
+	return nil
+}
+
+func (score *Score) TimeSigs() []*TimeSigChange {
+	return score.meter
+}
+
+/* returns the time signature in effect at 'beat' */
+func (score *Score) TimeSigAt(beat *BeatRef) TimeSig {
+	for b := beat; b != nil; b = b.prev {
+		if tc := score.TimeSigChangeAt(b); tc != nil {
+			return tc.TimeSig
+		}
+	}
+	return CommonTime
+}
+
+func (score *Score) BarPos(beat *BeatRef) BarPos {
+	pos := BarPos{1, 0, score.TimeSigAt(score.Head)}
+	for b := score.Head; b != nil && b != beat; b = b.next {
+		pos = score.NextBarPos(b, pos)
+	}
+	return pos
+}
+
+/* NextBarPos returns the position of the beat following 'beat', which is at 'pos'. */
+func (score *Score) NextBarPos(beat *BeatRef, pos BarPos) BarPos {
+	if beat.next != nil {
+		if tc := score.TimeSigChangeAt(beat.next); tc != nil {
+			return BarPos{pos.Bar + 1, 0, tc.TimeSig}
+		}
+	}
+	if pos.Beat + 1 >= pos.Beats {
+		return BarPos{pos.Bar + 1, 0, pos.TimeSig}
+	}
+	return BarPos{pos.Bar, pos.Beat + 1, pos.TimeSig}
+}
+
+/* returns the first downbeat at or after 'beat', or nil if there is none */
+func (score *Score) NextDownbeat(beat *BeatRef) *BeatRef {
+	pos := score.BarPos(beat)
+	for b := beat; b != nil; b = b.next {
+		if pos.IsDownbeat() {
+			return b
+		}
+		pos = score.NextBarPos(b, pos)
+	}
+	return nil
+}
+
+/* LoadTimeSigs replaces the meter without recording history. Keys index into the beat list. */
+func (score *Score) LoadTimeSigs(sigs map[int]TimeSig) {
+	meter := make([]*TimeSigChange, 0, len(sigs))
+	i := 0
+	for b := score.Head; b != nil; b = b.next {
+		if ts, ok := sigs[i]; ok {
+			meter = append(meter, &TimeSigChange{b, ts})
+		}
+		i++
+	}
+	score.meter = meter
+	score.plumb.C <- MeterChanged{}
+}
+
+/* SetTimeSig starts a new meter at 'beat'. If the meter matches the one that would
+ * otherwise be in effect, any existing change at 'beat' is removed instead. */
+func (score *Score) SetTimeSig(beat *BeatRef, ts TimeSig) bool {
+	return score.update(&SetTimeSigOp{beat: beat, ts: ts})
+}
+
+type SetTimeSigOp struct {
+	beat *BeatRef
+	ts TimeSig
+	orig []*TimeSigChange
+}
+
+func (op *SetTimeSigOp) apply(score *Score) interface{} {
+	var prev TimeSig = CommonTime
+	if op.beat.prev != nil {
+		prev = score.TimeSigAt(op.beat.prev)
+	}
+	existing := score.TimeSigChangeAt(op.beat)
+	if existing == nil && op.ts == prev {
+		return nil
+	} else if existing != nil && existing.TimeSig == op.ts {
+		return nil
+	}
+	op.orig = score.meter
+	/* build a new slice rather than modify in place; readers don't synchronise with us */
+	meter := make([]*TimeSigChange, 0, len(score.meter) + 1)
+	for _, tc := range score.meter {
+		if tc.Beat != op.beat {
+			meter = append(meter, tc)
+		}
+	}
+	if op.ts != prev {
+		meter = append(meter, &TimeSigChange{op.beat, op.ts})
+	}
+	score.meter = meter
+	return MeterChanged{}
+}
+
+func (op *SetTimeSigOp) undo(score *Score) {
+	score.meter = op.orig
+}
@@ -0,0 +1,37 @@
+package score
+
+import (
+	. "github.com/sqweek/sqribe/core/types"
+)
+
+/* Nudge sets how many frames each of 'notes' is played away from its written position,
+ * eg. to follow the timing of the recording. The written rhythm is unchanged. */
+func (score *Score) Nudge(nudges []FrameN, notes... StaffNote) bool {
+	return score.update(&NudgeOp{nudges: nudges, notes: notes})
+}
+
+type NudgeOp struct {
+	nudges []FrameN
+	notes []StaffNote
+	orig []FrameN
+}
+
+func (op *NudgeOp) apply(score *Score) interface{} {
+	op.orig = make([]FrameN, len(op.notes))
+	changed := false
+	for i, sn := range op.notes {
+		op.orig[i] = sn.Note.Nudge
+		changed = changed || sn.Note.Nudge != op.nudges[i]
+		sn.Note.Nudge = op.nudges[i]
+	}
+	if !changed {
+		return nil
+	}
+	return notesChanged(op.notes)
+}
+
+func (op *NudgeOp) undo(score *Score) {
+	for i, sn := range op.notes {
+		sn.Note.Nudge = op.orig[i]
+	}
+}
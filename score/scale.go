@@ -1,35 +1,78 @@
 package score
 
 import (
+	"strings"
+
 	"github.com/sqweek/sqribe/midi"
 )
 
 type KeySig int
 
+/* Mode is the number of scale steps from the tonic of the major key sharing its key
+ * signature up to the tonic of the mode */
+type Mode int
+
+const (
+	Major Mode = iota
+	Dorian
+	Phrygian
+	Lydian
+	Mixolydian
+	Minor
+	Locrian
+	NModes
+)
+
+var modeNames []string = []string{"Major", "Dorian", "Phrygian", "Lydian", "Mixolydian", "Minor", "Locrian"}
+
 type Clef struct {
 	Name string
 	Origin uint8 // unaltered midi pitch of center note
 	tone int // tone index of center note (relative to C scale)
+	drums bool // lines stand for GM drum sounds rather than pitches
 }
 
-var TrebleClef Clef = Clef{"Treble", midi.PitchB5, 6}
-var BassClef Clef = Clef{"Bass", midi.PitchD4, 1}
-var AltoClef Clef = Clef{"Alto", midi.PitchC5, 0}
-var TenorClef Clef = Clef{"Tenor", midi.PitchA4, 5}
+var TrebleClef Clef = Clef{"Treble", midi.PitchB5, 6, false}
+var BassClef Clef = Clef{"Bass", midi.PitchD4, 1, false}
+var AltoClef Clef = Clef{"Alto", midi.PitchC5, 0, false}
+var TenorClef Clef = Clef{"Tenor", midi.PitchA4, 5, false}
+/* the percussion clef is laid out like the treble clef, for the sake of MusicXML's display
+ * positions, but see GMDrums for what its lines mean */
+var PercussionClef Clef = Clef{"Percussion", midi.PitchB5, 6, true}
+
+/* Clefs lists every clef a staff can take */
+var Clefs []*Clef = []*Clef{&TrebleClef, &BassClef, &AltoClef, &TenorClef, &PercussionClef}
 
 var stdClef map[uint8]*Clef
 
 func init() {
 	stdClef = make(map[uint8]*Clef)
-	for _, clef := range([]*Clef{&TrebleClef, &BassClef, &AltoClef}) {
-		stdClef[clef.Origin] = clef
+	for _, clef := range Clefs {
+		if !clef.drums {
+			stdClef[clef.Origin] = clef
+		}
 	}
 }
 
+/* FindClef returns the pitched clef centered on 'origin', or nil if there isn't one */
 func FindClef(origin uint8) *Clef {
 	return stdClef[origin]
 }
 
+/* ClefNamed looks up a clef by name, ignoring case */
+func ClefNamed(name string) *Clef {
+	for _, clef := range Clefs {
+		if strings.ToLower(clef.Name) == strings.ToLower(name) {
+			return clef
+		}
+	}
+	return nil
+}
+
+func (clef *Clef) IsPercussion() bool {
+	return clef.drums
+}
+
 /* degrees: do di re ri mi fa fi so si la li ti
  * scales: C D E F G A B */
 var degree2scale []int = []int{0, -1, 1, -1, 2, 3, -1, 4, -1, 5, -1, 6}
@@ -38,9 +81,22 @@ var scale2degree []int = []int{0, 2, 4, 5, 7, 9, 11}
 var scaleSharps []KeySig = []KeySig{1, 3, 5, 0, 2, 4, 6}
 
 // delta is the number of scale lines from the stave's center note. +ve = higher pitch
-func (staff *Staff) PitchForLine(delta int) uint8 {
-	pitch := int(staff.clef.Origin)
-	scale0 := staff.clef.tone
+// the key in effect at 'beat' applies (nil for the start of the staff).
+func (staff *Staff) PitchForLine(beat *BeatRef, delta int) uint8 {
+	if staff.clef.drums {
+		return DrumForLine(delta).Key
+	}
+	pitch, s := staff.clef.naturalForLine(delta)
+	/* apply the key signature */
+	key, _ := staff.WrittenKeyAt(beat)
+	pitch += key.accidental(s)
+	return staff.concert(uint8(pitch))
+}
+
+/* returns the unaltered midi pitch and tone index of the line 'delta' lines from center */
+func (clef *Clef) naturalForLine(delta int) (int, int) {
+	pitch := int(clef.Origin)
+	scale0 := clef.tone
 	s := scale0 + delta
 	/* first deal with octaves, in "scale" space */
 	for s < 0 {
@@ -52,31 +108,77 @@ func (staff *Staff) PitchForLine(delta int) uint8 {
 		s -= 7
 	}
 	/* then apply the intra-scale delta */
-	pitch += scale2degree[s] - scale2degree[scale0]
-	/* finally, apply the key signature */
-	pitch += staff.accidental(s)
-	return uint8(pitch)
+	return pitch + scale2degree[s] - scale2degree[scale0], s
+}
+
+func (mode Mode) String() string {
+	if mode < 0 || mode >= NModes {
+		return "???"
+	}
+	return modeNames[mode]
+}
+
+/* ModeNamed looks up a mode by name, ignoring case. "ionian" and "aeolian" are also accepted. */
+func ModeNamed(name string) (Mode, bool) {
+	switch strings.ToLower(name) {
+	case "ionian": return Major, true
+	case "aeolian": return Minor, true
+	}
+	for mode, s := range modeNames {
+		if strings.ToLower(s) == strings.ToLower(name) {
+			return Mode(mode), true
+		}
+	}
+	return Major, false
 }
 
 func (nsharps KeySig) String() string {
-	switch nsharps {
-	case -7: return "Cb Major"
-	case -6: return "Gb Major"
-	case -5: return "Db Major"
-	case -4: return "Ab Major"
-	case -3: return "Eb Major"
-	case -2: return "Bb Major"
-	case -1: return "F Major"
-	case 0: return "C Major"
-	case 1: return "G Major"
-	case 2: return "D Major"
-	case 3: return "A Major"
-	case 4: return "E Major"
-	case 5: return "B Major"
-	case 6: return "F# Major"
-	case 7: return "C# Major"
-	}
-	return "???"
+	return nsharps.Name(Major)
+}
+
+/* Name returns the name of the key with this signature in the given mode, eg. "A Minor" */
+func (nsharps KeySig) Name(mode Mode) string {
+	if nsharps < -7 || nsharps > 7 || mode < 0 || mode >= NModes {
+		return "???"
+	}
+	tone := nsharps.tonic(mode)
+	name := "CDEFGAB"[tone:tone+1]
+	switch nsharps.accidental(tone) {
+	case 1: name += "#"
+	case -1: name += "b"
+	}
+	return name + " " + mode.String()
+}
+
+/* returns the tone index (relative to C scale) of the tonic */
+func (nsharps KeySig) tonic(mode Mode) int {
+	major := (4 * int(nsharps)) % 7 // each sharp moves the tonic up a fifth
+	if major < 0 {
+		major += 7
+	}
+	return (major + int(mode)) % 7
+}
+
+/* returns the scale degrees (1 = tonic) which the mode commonly raises - the leading note
+ * when the 7th is a whole tone below the tonic, and also the 6th of melodic minor */
+func (mode Mode) raised() []int {
+	switch mode {
+	case Minor: return []int{7, 6}
+	case Dorian, Phrygian, Mixolydian: return []int{7}
+	}
+	return nil
+}
+
+/* returns the tone which is spelled with a raised accidental to produce 'pitch',
+ * if 'pitch' is one of the mode's raised degrees */
+func (nsharps KeySig) raisedTone(mode Mode, pitch uint8) (int, bool) {
+	for _, degree := range mode.raised() {
+		tone := (nsharps.tonic(mode) + degree - 1) % 7
+		if (scale2degree[tone] + nsharps.accidental(tone) + 1 - int(pitch % 12) + 24) % 12 == 0 {
+			return tone, true
+		}
+	}
+	return 0, false
 }
 
 func (nsharps KeySig) IsSharps() bool {
@@ -92,45 +194,20 @@ func (nsharps KeySig) accidental(tone int) int {
 	return 0
 }
 
-func (staff *Staff) accidental(tone int) int {
-	return staff.nsharps.accidental(tone)
-}
-
 func (key KeySig) toneForPitch(pitch uint8) int {
 	degree := int(pitch % 12)
 	for s, _ := range(scale2degree) {
-		if scale2degree[s] + key.accidental(s) == degree {
+		/* mod 12 since eg. Cb and B# cross the octave */
+		if (scale2degree[s] + key.accidental(s) + 12) % 12 == degree {
 			return s
 		}
 	}
 	return -1
 }
 
-func lineWithAccidental(clef *Clef, nsharps KeySig, pitch uint8, dir int) (int, *int) {
-	p := pitch + uint8(dir)
-	tone := nsharps.toneForPitch(p)
-	line, ok := lineForPitch(clef, nsharps, p)
-	if !ok {
-		return tone, nil
-	}
-	a := nsharps.accidental(tone) - dir
-	return line, &a
-}
-
-func chooseAccidental(clef *Clef, key KeySig, pitch uint8) (int, *int) {
-	// TODO consider other notes/accidentals in the bar/song
-	flat, fax := lineWithAccidental(clef, key, pitch, 1)
-	sharp, sax := lineWithAccidental(clef, key, pitch, -1)
-	// at least one of ftone/stone is guaranteed to not be -1
-	if key.IsSharps() && sax != nil && *sax != 2 {
-		return sharp, sax
-	} else if !key.IsSharps() && fax != nil && *fax != -2 {
-		return flat, fax
-	} else if fax == nil || (*fax == -2 && sax != nil) {
-		return sharp, sax
-	} else {
-		return flat, fax
-	}
+func chooseAccidental(clef *Clef, key KeySig, mode Mode, pitch uint8) (int, *int) {
+	sp := spell(clef, key, mode, pitch, nil, 0)
+	return sp.Line, &sp.Accidental
 }
 
 /* raw pitch -> line conversion, no accidentals considered. */
@@ -139,8 +216,13 @@ func lineForPitch(clef *Clef, nsharps KeySig, pitch uint8) (int, bool) {
 	if tone == -1 {
 		return 0, false
 	}
+	return lineForTone(clef, tone, int(pitch) - nsharps.accidental(tone)), true
+}
+
+/* returns the line of 'tone', in the octave of 'natural' (the pitch without accidentals) */
+func lineForTone(clef *Clef, tone int, natural int) int {
 	octave := 0
-	d := int(pitch) - int(clef.Origin - clef.Origin % 12)
+	d := natural - int(clef.Origin - clef.Origin % 12)
 	for d < 0 {
 		octave -= 7
 		d += 12
@@ -149,19 +231,34 @@ func lineForPitch(clef *Clef, nsharps KeySig, pitch uint8) (int, bool) {
 		octave += 7
 		d -= 12
 	}
-	delta := -clef.tone + octave + tone
-	return delta, true
+	return -clef.tone + octave + tone
 }
 
-func (staff *Staff) LineForPitch(pitch uint8) (int, *int) {
-	return staff.clef.LineForPitch(staff.nsharps, pitch)
+func (staff *Staff) LineForPitch(beat *BeatRef, pitch uint8) (int, *int) {
+	key, mode := staff.WrittenKeyAt(beat)
+	return staff.clef.LineForPitch(key, mode, staff.written(pitch))
 }
 
-func (clef *Clef) LineForPitch(key KeySig, pitch uint8) (int, *int) {
+/* LineForNote is like LineForPitch but respects the note's explicit spelling */
+func (staff *Staff) LineForNote(note *Note) (int, *int) {
+	if note.Spelling == nil {
+		return staff.LineForPitch(note.Beat, note.Pitch)
+	}
+	sp := staff.SpellNote(note)
+	if !sp.Show {
+		return sp.Line, nil
+	}
+	return sp.Line, &sp.Accidental
+}
+
+func (clef *Clef) LineForPitch(key KeySig, mode Mode, pitch uint8) (int, *int) {
+	if clef.drums {
+		return spellDrum(clef, pitch).Line, nil
+	}
 	if delta, ok := lineForPitch(clef, key, pitch); ok {
 		return delta, nil
 	}
-	return chooseAccidental(clef, key, pitch)
+	return chooseAccidental(clef, key, mode, pitch)
 }
 
 func (clef Clef) tones2lines(tones []int) []int {
@@ -196,6 +293,9 @@ func (nsharps KeySig) Count() int {
 
 func (clef Clef) accidentalLines(nsharps KeySig) []int {
 	lines := make([]int, 0, 7)
+	if clef.drums {
+		return lines // unpitched; the key doesn't apply
+	}
 	diff := clef.tone
 	if diff > 3 {
 		diff -= 7
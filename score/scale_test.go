@@ -5,6 +5,8 @@ import (
 	"testing"
 
 	"github.com/sqweek/sqribe/midi"
+
+	. "github.com/sqweek/sqribe/core/types"
 )
 
 var origin map[KeySig]uint8
@@ -45,7 +47,7 @@ func testClefLines(t *testing.T, clef *Clef, key KeySig) {
 	lines := make([]struct{uint8; int; string}, 0)
 	for _, d := range scale2degree {
 		pitch := origin[key] + uint8(d)
-		line, ax := clef.LineForPitch(key, pitch)
+		line, ax := clef.LineForPitch(key, Major, pitch)
 		axs := ""
 		if ax != nil {
 			axs = axstr(*ax)
@@ -72,3 +74,108 @@ func TestScaleLines(t *testing.T) {
 		}
 	}
 }
+
+func TestHarmonicMinorLines(t *testing.T) {
+	for _, clef := range []*Clef{&TrebleClef, &BassClef} {
+		for key := KeySig(-7); key <= 7; key++ {
+			tonic := origin[key] + 9 // relative minor
+			lines := make(map[int]uint8)
+			for _, d := range []uint8{0, 2, 3, 5, 7, 8, 11} {
+				pitch := tonic + d
+				line, _ := clef.LineForPitch(key, Minor, pitch)
+				if prev, ok := lines[line]; ok {
+					t.Errorf("%s %s: %s and %s share line %d", clef.Name, key.Name(Minor), midi.PitchName(prev), midi.PitchName(pitch), line)
+				}
+				lines[line] = pitch
+			}
+		}
+	}
+}
+
+func TestKeyNames(t *testing.T) {
+	for _, test := range []struct{key KeySig; mode Mode; name string}{
+		{0, Major, "C Major"},
+		{0, Minor, "A Minor"},
+		{-3, Minor, "C Minor"},
+		{3, Minor, "F# Minor"},
+		{0, Dorian, "D Dorian"},
+		{-6, Major, "Gb Major"},
+		{7, Minor, "A# Minor"},
+	} {
+		if name := test.key.Name(test.mode); name != test.name {
+			t.Errorf("KeySig(%d).Name(%d) = %s, expected %s", int(test.key), int(test.mode), name, test.name)
+		}
+	}
+}
+
+func TestKeyChangeSpelling(t *testing.T) {
+	score := Score{BeatList: mkBeats([]FrameN{0, 100, 200, 300})}
+	staff := MkStaff("", &TrebleClef, 0, Major)
+	score.LoadKeys(staff, map[int]KeySigChange{2: {nil, -1, Major}})
+	bb := uint8(midi.PitchB5 - 1)
+	for i, b := 0, score.Head; b != nil; i, b = i + 1, b.next {
+		line, ax := staff.LineForPitch(b, bb)
+		if i < 2 && (line != 0 || ax == nil || *ax != -1) {
+			t.Errorf("beat %d: Bb should be an accidental on line 0 in C major; got %d %v", i, line, ax)
+		} else if i >= 2 && (line != 0 || ax != nil) {
+			t.Errorf("beat %d: Bb should be in the key on line 0 in F major; got %d %v", i, line, ax)
+		}
+		if pitch := staff.PitchForLine(b, 0); (i < 2) != (pitch == midi.PitchB5) {
+			t.Errorf("beat %d: line 0 is %s", i, midi.PitchName(pitch))
+		}
+	}
+}
+
+func TestPercussionLines(t *testing.T) {
+	staff := MkStaff("", &PercussionClef, 2, Major)
+	for line := -5; line <= 7; line++ {
+		key := staff.PitchForLine(nil, line)
+		if l, ax := staff.LineForPitch(nil, key); l != line || ax != nil {
+			t.Errorf("line %d holds drum %d, which is written on line %d (accidental %v)", line, key, l, ax)
+		}
+		if sp := staff.SpellPitch(nil, key); sp.Drum != key || sp.Line != line || DrumForDisplay(uint8(sp.natural)).Key != key {
+			t.Errorf("line %d: drum %d displayed as %s%d", line, key, sp.Step(), sp.Octave())
+		}
+	}
+	for _, test := range [][2]uint8{{42, 46}, {46, 42}, {36, 36}, {60, 45}} {
+		if next := nextDrum(test[0]); next != test[1] {
+			t.Errorf("drum after %d should be %d, got %d", test[0], test[1], next)
+		}
+	}
+	if lines := PercussionClef.accidentalLines(2); len(lines) != 0 {
+		t.Errorf("percussion staff shouldn't show a key signature; got %v", lines)
+	}
+}
+
+func TestTransposition(t *testing.T) {
+	for _, test := range []struct{key KeySig; semitones int; transposed KeySig}{
+		{0, -2, 2}, // concert C is written in D for an instrument in Bb
+		{0, -7, 1},
+		{0, -9, 3},
+		{-3, -2, -1},
+		{7, 0, 7},
+		{0, 1, 5},
+		{0, -1, -5},
+	} {
+		if key := test.key.Transpose(-test.semitones); key != test.transposed {
+			t.Errorf("%v for an instrument %+d should be written in %v, got %v", test.key, test.semitones, test.transposed, key)
+		}
+	}
+	for semitones, diatonic := range map[int]int{-2: -1, -7: -4, -9: -5, -14: -8, 12: 7} {
+		if d := Diatonic(semitones); d != diatonic {
+			t.Errorf("Diatonic(%d) = %d, expected %d", semitones, d, diatonic)
+		}
+	}
+	staff := MkStaff("", &TrebleClef, -1, Major)
+	staff.transpose = -2
+	if key, _ := staff.WrittenKeyAt(nil); key != 1 {
+		t.Errorf("F major on a Bb staff should be written in G, got %v", key)
+	}
+	bb := uint8(midi.PitchB5 - 1)
+	if sp := staff.SpellPitch(nil, bb); sp.Step() != "C" || sp.Line != 1 || sp.Show {
+		t.Errorf("concert Bb should be written as C on line 1, got %s on %d", sp.Step(), sp.Line)
+	}
+	if pitch := staff.PitchForLine(nil, 1); pitch != bb {
+		t.Errorf("line 1 should sound %s, got %s", midi.PitchName(bb), midi.PitchName(pitch))
+	}
+}
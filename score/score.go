@@ -53,6 +53,7 @@ type historyItem struct {
 
 type Score struct {
 	BeatList
+	meter []*TimeSigChange
 	staves []*Staff
 	beatLen *big.Rat
 	plumb *plumb.Port
@@ -60,6 +61,8 @@ type Score struct {
 	updates chan request
 	history []historyItem
 	undone int // counter of number steps currently undone (for redo)
+	group *groupedOp // collects ops while a Group is in progress
+	grouping int // depth of nested Groups
 
 	quantApply chan chan bool
 	quantCalc chan chan QuantizeBeats
@@ -82,22 +85,35 @@ func MkScore(plumb *plumb.Port) *Score {
 			change := req.op.apply(&score)
 			req.result <- change
 			if op, ok := req.op.(UndoableOp); ok && change != nil {
-				if score.undone != 0 {
-					score.history = score.history[0:len(score.history) - score.undone]
-					score.undone = 0
+				if score.group != nil {
+					score.group.ops = append(score.group.ops, op)
+					if cs, ok := change.(changes); ok {
+						score.group.changes = append(score.group.changes, cs...)
+					} else {
+						score.group.changes = append(score.group.changes, change)
+					}
+				} else {
+					score.record(op, change)
 				}
-				if len(score.history) == cap(score.history) {
-					// forget oldest change
-					copy(score.history[0:], score.history[1:])
-					score.history = score.history[:len(score.history) - 1]
-				}
-				score.history = append(score.history, historyItem{op, change})
 			}
 		}
 	}()
 	return &score
 }
 
+func (score *Score) record(op UndoableOp, change interface{}) {
+	if score.undone != 0 {
+		score.history = score.history[0:len(score.history) - score.undone]
+		score.undone = 0
+	}
+	if len(score.history) == cap(score.history) {
+		// forget oldest change
+		copy(score.history[0:], score.history[1:])
+		score.history = score.history[:len(score.history) - 1]
+	}
+	score.history = append(score.history, historyItem{op, change})
+}
+
 func (score *Score) Close() {
 	close(score.updates)
 }
@@ -114,13 +130,22 @@ func (score *Score) Unsub(origin interface{}) {
 	score.plumb.Unsub(origin)
 }
 
+/* an op which affects several aspects of the score returns one event for each */
+type changes []interface{}
+
 /* returns true if the op actually changed something */
 func (score *Score) update(op ScoreOp) bool {
 	req := request{op, make(chan interface{})}
 	score.updates <- req
 	change := <-req.result
 	if change != nil {
-		score.plumb.C <- change
+		if cs, ok := change.(changes); ok {
+			for _, c := range cs {
+				score.plumb.C <- c
+			}
+		} else {
+			score.plumb.C <- change
+		}
 		return true
 	}
 	return false
@@ -150,6 +175,56 @@ func (score *Score) Redo() bool {
 	return score.update(&RedoOp{})
 }
 
+/* Group calls 'fn', and makes the changes it makes to the score through the usual methods
+ * a single step of the history, so that one Undo reverts them all. */
+func (score *Score) Group(fn func()) {
+	score.update(&groupOp{begin: true})
+	defer score.update(&groupOp{begin: false})
+	fn()
+}
+
+type groupOp struct {
+	begin bool
+}
+
+func (op *groupOp) apply(score *Score) interface{} {
+	if op.begin {
+		if score.grouping == 0 {
+			score.group = &groupedOp{}
+		}
+		score.grouping++
+		return nil
+	}
+	score.grouping--
+	if score.grouping == 0 {
+		group := score.group
+		score.group = nil
+		if len(group.ops) > 0 {
+			score.record(group, group.changes)
+		}
+	}
+	return nil
+}
+
+/* groupedOp is the ops of a Group, undone and redone together */
+type groupedOp struct {
+	ops []UndoableOp
+	changes changes
+}
+
+func (op *groupedOp) apply(score *Score) interface{} {
+	for _, o := range op.ops {
+		o.apply(score)
+	}
+	return op.changes
+}
+
+func (op *groupedOp) undo(score *Score) {
+	for i := len(op.ops) - 1; i >= 0; i-- {
+		op.ops[i].undo(score)
+	}
+}
+
 type RedoOp struct{}
 
 func (op *RedoOp) apply(score *Score) interface{} {
@@ -0,0 +1,331 @@
+package score
+
+import (
+	"sort"
+	"strings"
+
+	. "github.com/sqweek/sqribe/core/types"
+)
+
+/* Spelled is the written form of a pitch: the staff line it sits on and the accidental
+ * applied to that line's natural tone. Show is false when the accidental is implied by
+ * the key signature or by an earlier note in the same measure. */
+type Spelled struct {
+	Line int
+	Accidental int
+	Show bool
+	Drum uint8 // GM percussion key of an unpitched note, 0 if pitched
+	tone int // tone index (relative to C scale)
+	natural int // midi pitch without the accidental
+}
+
+/* Unpitched is true for a percussion note, whose Step and Octave give its display position */
+func (sp Spelled) Unpitched() bool {
+	return sp.Drum != 0
+}
+
+/* Step returns the letter name of the spelled note */
+func (sp Spelled) Step() string {
+	return "CDEFGAB"[sp.tone:sp.tone+1]
+}
+
+/* Octave returns the midi octave of the spelled note's letter, so that eg. B#4 and C5
+ * sound the same but B# belongs to the lower octave */
+func (sp Spelled) Octave() int {
+	return sp.natural / 12
+}
+
+/* Spelling names the letter a note is written on (a tone index relative to the C scale, so
+ * 0 = C .. 6 = B) and the accidental applied to it, in semitones. */
+type Spelling struct {
+	Step int
+	Alter int
+}
+
+func (s Spelling) String() string {
+	acc := ""
+	if s.Alter > 0 {
+		acc = strings.Repeat("#", s.Alter)
+	} else if s.Alter < 0 {
+		acc = strings.Repeat("b", -s.Alter)
+	}
+	return "CDEFGAB"[s.Step:s.Step+1] + acc
+}
+
+/* ParseSpelling reads a letter followed by up to two sharps or flats, eg. "Db" or "F##" */
+func ParseSpelling(txt string) (Spelling, bool) {
+	if len(txt) < 1 || len(txt) > 3 {
+		return Spelling{}, false
+	}
+	step := strings.Index("CDEFGAB", txt[0:1])
+	if step == -1 {
+		return Spelling{}, false
+	}
+	acc := txt[1:]
+	switch {
+	case acc == strings.Repeat("#", len(acc)):
+		return Spelling{step, len(acc)}, true
+	case acc == strings.Repeat("b", len(acc)):
+		return Spelling{step, -len(acc)}, true
+	}
+	return Spelling{}, false
+}
+
+/* Spelling returns the letter and accidental of a spelled note */
+func (sp Spelled) Spelling() Spelling {
+	return Spelling{sp.tone, sp.Accidental}
+}
+
+/* Enharmonics lists the ways 'pitch' can be written with at most one accidental,
+ * sharpest first */
+func Enharmonics(pitch uint8) []Spelling {
+	spellings := make([]Spelling, 0, 2)
+	for a := 1; a >= -1; a-- {
+		natural := int(pitch) - a
+		if natural < 0 {
+			continue
+		}
+		if tone := degree2scale[natural % 12]; tone != -1 {
+			spellings = append(spellings, Spelling{tone, a})
+		}
+	}
+	return spellings
+}
+
+/* spellAs writes 'pitch' with the given spelling, if the spelling actually fits the pitch */
+func spellAs(clef *Clef, key KeySig, pitch uint8, s Spelling, alters map[int]int) (Spelled, bool) {
+	if clef.drums {
+		return Spelled{}, false
+	}
+	natural := int(pitch) - s.Alter
+	if natural < 0 || s.Step < 0 || s.Step >= len(scale2degree) || natural % 12 != scale2degree[s.Step] {
+		return Spelled{}, false
+	}
+	line := lineForTone(clef, s.Step, natural)
+	cur, ok := alters[line]
+	if !ok {
+		cur = key.accidental(s.Step)
+	}
+	return Spelled{line, s.Alter, s.Alter != cur, 0, s.Step, natural}, true
+}
+
+/* spell picks the line and accidental for 'pitch'. 'alters' holds accidentals already
+ * written on each line in the current measure (nil for none), and 'dir' is the direction
+ * the melody moves through the note (+1 rising, -1 falling, 0 unknown). A spelling which
+ * needs no accidental always wins; after that the mode's raised degrees, then single
+ * accidentals in the direction of travel (sharps rising, flats falling) are preferred. */
+func spell(clef *Clef, key KeySig, mode Mode, pitch uint8, alters map[int]int, dir int) Spelled {
+	if clef.drums {
+		return spellDrum(clef, pitch)
+	}
+	var best Spelled
+	bestCost := -1
+	raised, isRaised := key.raisedTone(mode, pitch)
+	for _, a := range []int{0, 1, -1, 2, -2} {
+		natural := int(pitch) - a
+		if natural < 0 {
+			continue
+		}
+		tone := degree2scale[natural % 12]
+		if tone == -1 {
+			continue
+		}
+		line := lineForTone(clef, tone, natural)
+		cur, ok := alters[line]
+		if !ok {
+			cur = key.accidental(tone)
+		}
+		sp := Spelled{line, a, a != cur, 0, tone, natural}
+		if a == cur {
+			return sp
+		}
+		cost := 4
+		if isRaised && raised == tone && dir >= 0 {
+			cost = 1
+		} else {
+			if a == 2 || a == -2 {
+				cost += 12
+			}
+			if d := natural % 12; (a > 0 && (d == 4 || d == 11)) || (a < 0 && (d == 0 || d == 5)) {
+				cost += 6 // E#, B#, Cb, Fb
+			}
+			raising := a > cur
+			switch {
+			case dir != 0 && raising == (dir > 0):
+				cost -= 2
+			case dir != 0:
+				cost += 2
+			case raising == key.IsSharps():
+				cost -= 1
+			default:
+				cost += 1
+			}
+		}
+		if bestCost == -1 || cost < bestCost {
+			best, bestCost = sp, cost
+		}
+	}
+	return best
+}
+
+/* SpellPitch spells 'pitch' according to the key in effect at 'beat', without regard to
+ * any other notes. */
+func (staff *Staff) SpellPitch(beat *BeatRef, pitch uint8) Spelled {
+	key, mode := staff.WrittenKeyAt(beat)
+	return spell(staff.clef, key, mode, staff.written(pitch), nil, 0)
+}
+
+/* SpellNote is like SpellPitch but honours the note's explicit spelling, if it has one */
+func (staff *Staff) SpellNote(note *Note) Spelled {
+	if note.Spelling != nil {
+		key, _ := staff.WrittenKeyAt(note.Beat)
+		if sp, ok := spellAs(staff.clef, key, staff.written(note.Pitch), *note.Spelling, nil); ok {
+			return sp
+		}
+	}
+	return staff.SpellPitch(note.Beat, note.Pitch)
+}
+
+/* Spell works out how the notes of 'staff' within 'rng' are written. Notes from the start
+ * of the measure containing rng are considered, so that accidentals carry through the bar,
+ * and a note's neighbours decide which way a chromatic step is spelled. Notes with an
+ * explicit Spelling are written as asked. */
+func (score *Score) Spell(staff *Staff, rng TimeRange) map[*Note]Spelled {
+	spelled := make(map[*Note]Spelled)
+	notes := staff.notes
+	if !score.HasBeats() || len(notes) == 0 {
+		return spelled
+	}
+	/* find the downbeat of the first measure */
+	b := score.NearestBeat(rng.MinFrame())
+	if b.frame > rng.MinFrame() && b.prev != nil {
+		b = b.prev
+	}
+	pos := score.BarPos(b)
+	for ; pos.Beat > 0 && b.prev != nil; pos.Beat-- {
+		b = b.prev
+	}
+	i0 := sort.Search(len(notes), func(i int) bool { return notes[i].Beat.frame >= b.frame })
+	alters := make(map[int]int)
+	for i := i0; i < len(notes) && notes[i].Beat.frame <= rng.MaxFrame(); i++ {
+		note := notes[i]
+		for b != note.Beat && b.next != nil {
+			pos = score.NextBarPos(b, pos)
+			b = b.next
+			if pos.IsDownbeat() {
+				alters = make(map[int]int)
+			}
+		}
+		if note.Rest {
+			continue
+		}
+		dir := 0
+		if q, ok := neighbour(notes, i, 1); ok {
+			dir = sign(int(q) - int(note.Pitch))
+		} else if q, ok := neighbour(notes, i, -1); ok {
+			dir = sign(int(note.Pitch) - int(q))
+		}
+		key, mode := staff.WrittenKeyAt(note.Beat)
+		pitch := staff.written(note.Pitch)
+		sp, ok := Spelled{}, false
+		if note.Spelling != nil {
+			sp, ok = spellAs(staff.clef, key, pitch, *note.Spelling, alters)
+		}
+		if !ok {
+			sp = spell(staff.clef, key, mode, pitch, alters, dir)
+		}
+		alters[sp.Line] = sp.Accidental
+		spelled[note] = sp
+	}
+	return spelled
+}
+
+/* RespellNotes flips each of 'notes' to its next enharmonic spelling (eg. C# to Db), and
+ * pins the note to that spelling. */
+func (score *Score) RespellNotes(notes... StaffNote) {
+	score.update(&RespellNotesOp{notes: notes})
+}
+
+type RespellNotesOp struct {
+	notes []StaffNote
+	orig []*Spelling
+}
+
+func (op *RespellNotesOp) apply(score *Score) interface{} {
+	/* work out every new spelling before changing any, since spelling depends on context */
+	respelled := make([]*Spelling, len(op.notes))
+	for i, sn := range op.notes {
+		if sn.Note.Rest || sn.Staff.clef.drums {
+			continue
+		}
+		f := sn.Note.Beat.frame
+		sp, ok := score.Spell(sn.Staff, FrameRange{Min: f, Max: f})[sn.Note]
+		if !ok {
+			sp = sn.Staff.SpellNote(sn.Note)
+		}
+		cur := sp.Spelling()
+		alts := Enharmonics(sn.Staff.written(sn.Note.Pitch))
+		next := alts[0]
+		for j, alt := range alts {
+			if alt == cur {
+				next = alts[(j + 1) % len(alts)]
+				break
+			}
+		}
+		respelled[i] = &next
+	}
+	op.orig = make([]*Spelling, len(op.notes))
+	for i, sn := range op.notes {
+		op.orig[i] = sn.Note.Spelling
+		sn.Note.Spelling = respelled[i]
+	}
+	return notesChanged(op.notes)
+}
+
+func (op *RespellNotesOp) undo(score *Score) {
+	for i, sn := range op.notes {
+		sn.Note.Spelling = op.orig[i]
+	}
+}
+
+/* neighbour finds the pitch closest to notes[i] among the notes of the previous (step -1)
+ * or next (step 1) onset in the same voice. Only a step of a tone or less counts. */
+func neighbour(notes []*Note, i int, step int) (uint8, bool) {
+	note := notes[i]
+	at := func(k int, pos *Note) bool {
+		return notes[k].Beat == pos.Beat && notes[k].Offset.Cmp(pos.Offset) == 0
+	}
+	j := i
+	for j >= 0 && j < len(notes) && (at(j, note) || notes[j].Voice != note.Voice || notes[j].Rest) {
+		j += step
+	}
+	if j < 0 || j >= len(notes) {
+		return 0, false
+	}
+	best, found := uint8(0), false
+	for k := j; k >= 0 && k < len(notes) && at(k, notes[j]); k += step {
+		if notes[k].Voice != note.Voice || notes[k].Rest {
+			continue
+		}
+		d := int(notes[k].Pitch) - int(note.Pitch)
+		if d != 0 && d >= -2 && d <= 2 && (!found || abs(d) < abs(int(best) - int(note.Pitch))) {
+			best, found = notes[k].Pitch, true
+		}
+	}
+	return best, found
+}
+
+func sign(x int) int {
+	switch {
+	case x > 0: return 1
+	case x < 0: return -1
+	}
+	return 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,90 @@
+package score
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/sqweek/sqribe/midi"
+
+	. "github.com/sqweek/sqribe/core/types"
+)
+
+/* spells a line of quarter notes in C major on a treble staff, four to a bar. 'pinned'
+ * gives explicit spellings for some of the notes. */
+func spellRun(pitches []string, pinned map[int]string) ([]Spelled, error) {
+	frames := make([]FrameN, len(pitches) + 1)
+	for i := range frames {
+		frames[i] = FrameN(i * 100)
+	}
+	score := Score{BeatList: mkBeats(frames)}
+	staff := MkStaff("", &TrebleClef, 0, Major)
+	b := score.Head
+	for i, name := range pitches {
+		pitch, err := midi.ParsePitch(name)
+		if err != nil {
+			return nil, err
+		}
+		note := &Note{Pitch: pitch, Duration: big.NewRat(1, 1), Beat: b, Offset: new(big.Rat)}
+		if txt, ok := pinned[i]; ok {
+			sp, ok := ParseSpelling(txt)
+			if !ok {
+				return nil, fmt.Errorf("bad spelling %s", txt)
+			}
+			note.Spelling = &sp
+		}
+		staff.notes = append(staff.notes, note)
+		b = b.next
+	}
+	spelled := score.Spell(staff, FrameRange{Min: 0, Max: frames[len(frames) - 1]})
+	result := make([]Spelled, len(staff.notes))
+	for i, note := range staff.notes {
+		result[i] = spelled[note]
+	}
+	return result, nil
+}
+
+func TestSpellRuns(t *testing.T) {
+	for _, test := range []struct{
+		pitches []string
+		pinned map[int]string
+		spelled []string // step and accidental, with the accidental in brackets if it isn't shown
+	}{
+		{[]string{"C5", "Db5", "D5", "Eb5", "E5"}, nil, []string{"C(+0)", "C+1", "D(+0)", "D+1", "E(+0)"}},
+		{[]string{"E5", "Eb5", "D5", "Db5", "C5"}, nil, []string{"E(+0)", "E-1", "D(+0)", "D-1", "C(+0)"}},
+		/* the sharp carries through the bar, and a natural is needed to cancel it */
+		{[]string{"F5", "Gb5", "Gb5", "F5", "F5"}, nil, []string{"F(+0)", "F+1", "F(+1)", "F+0", "F(+0)"}},
+		/* an explicit spelling wins over the direction of travel, and still affects later notes */
+		{[]string{"C5", "Db5", "D5", "Db5"}, map[int]string{1: "Db"}, []string{"C(+0)", "D-1", "D+0", "D-1"}},
+		/* a spelling which doesn't fit the pitch is ignored */
+		{[]string{"C5", "Db5", "D5"}, map[int]string{1: "Eb"}, []string{"C(+0)", "C+1", "D(+0)"}},
+	} {
+		spelled, err := spellRun(test.pitches, test.pinned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, sp := range spelled {
+			s := sp.Step() + fmt.Sprintf("(%+d)", sp.Accidental)
+			if sp.Show {
+				s = sp.Step() + fmt.Sprintf("%+d", sp.Accidental)
+			}
+			if s != test.spelled[i] {
+				t.Errorf("%v: note %d spelled %s, expected %s", test.pitches, i, s, test.spelled[i])
+			}
+		}
+	}
+}
+
+func TestSpellingStrings(t *testing.T) {
+	for _, txt := range []string{"C", "F#", "Bb", "G##", "Fbb"} {
+		sp, ok := ParseSpelling(txt)
+		if !ok || sp.String() != txt {
+			t.Errorf("%s: parsed as %v (%v)", txt, sp, ok)
+		}
+	}
+	for _, txt := range []string{"", "H", "C#b", "Cbbb", "c"} {
+		if sp, ok := ParseSpelling(txt); ok {
+			t.Errorf("%s: expected parse failure, got %v", txt, sp)
+		}
+	}
+}
@@ -11,7 +11,15 @@ type Staff struct {
 	name string
 	clef *Clef
 	nsharps KeySig	// key signature (-ve for flats)
+	mode Mode
+	keys []*KeySigChange // modulations, in beat order
 	notes []*Note
+	voices int // number of voices in use
+	joined bool // grouped into one part with the staff above
+	transpose int // semitones from written to sounding pitch
+	grid *Grid // positions notes are quantized to, nil for the default
+	swing float64 // where the offbeat eighth sounds, 0 if played straight
+	dynamics []*DynamicMark // in beat order
 }
 
 type Note struct {
@@ -19,8 +27,18 @@ type Note struct {
 	Duration *big.Rat
 	Beat *BeatRef
 	Offset *big.Rat
+	Spelling *Spelling /* explicit enharmonic spelling, nil to work it out from context */
+	Tied bool /* held into the next note of the same pitch */
+	Rest bool /* an explicit rest; Pitch only matters for ordering */
+	Voice uint8 /* independent line within the staff, 0 for the first */
+	Nudge FrameN /* how far the note is played from its written position */
+	Velocity uint8 /* 0 to play at the staff's velocity */
+	Articulations Articulation /* staccato, accent, etc. */
 }
 
+/* NVoices is the number of voices a staff can hold */
+const NVoices = 4
+
 type StaffChanged struct {
 	Staves map[*Staff]struct{}
 }
@@ -59,24 +77,19 @@ func (score *Score) Key() KeySig {
 	return score.staves[0].nsharps
 }
 
-func (score *Score) KeyChange(dsharps int) {
-	for _, staff := range score.staves {
-		staff.nsharps += KeySig(dsharps)
-		if staff.nsharps > 7 {
-			staff.nsharps -= 12
-		} else if staff.nsharps < -7 {
-			staff.nsharps += 12
-		}
+func (score *Score) Mode() Mode {
+	if len(score.staves) == 0 {
+		return Major
 	}
-	score.plumb.C <- KeyChanged(staffChanged(score.staves...))
+	return score.staves[0].mode
 }
 
 func (score *Score) Staves() []*Staff {
 	return score.staves
 }
 
-func MkStaff(name string, clef *Clef, key KeySig) *Staff {
-	return &Staff{name: name, clef: clef, nsharps: key}
+func MkStaff(name string, clef *Clef, key KeySig, mode Mode) *Staff {
+	return &Staff{name: name, clef: clef, nsharps: key, mode: mode}
 }
 
 func (score *Score) SetStaves(staves []*Staff) {
@@ -110,6 +123,31 @@ func (op *AddStaffOp) undo(score *Score) {
 	score.staves = score.staves[:len(score.staves)-1]
 }
 
+/* SetClef changes the clef of 'staff'. Notes keep their pitch (or, to and from the
+ * percussion clef, their note number) and move to the lines of the new clef. */
+func (score *Score) SetClef(staff *Staff, clef *Clef) bool {
+	return score.update(&SetClefOp{staff: staff, clef: clef})
+}
+
+type SetClefOp struct {
+	staff *Staff
+	clef *Clef
+	orig *Clef
+}
+
+func (op *SetClefOp) apply(score *Score) interface{} {
+	op.orig = op.staff.clef
+	if op.orig == op.clef {
+		return nil
+	}
+	op.staff.clef = op.clef
+	return KeyChanged(staffChanged(op.staff)) // the key signature moves with the clef
+}
+
+func (op *SetClefOp) undo(score *Score) {
+	op.staff.clef = op.orig
+}
+
 func (score *Score) Beatf(note *Note) BeatPoint {
 	f, _ := note.Offset.Float64()
 	return BeatPt{note.Beat, f}
@@ -121,8 +159,8 @@ func (score *Score) EndBeatf(note *Note) BeatPoint {
 	r.Add(&r, note.Duration)
 	f, _ := r.Float64()
 	b := note.Beat
-	for f > 1 {
-		b = b.LNext()
+	for f > 1 && b.next != nil {
+		b = b.next
 		f -= 1
 	}
 	return BeatPt{b, f}
@@ -141,6 +179,17 @@ func (note *Note) Cmp(note2 *Note) int {
 	}
 	d := note.Offset.Cmp(note2.Offset)
 	if d == 0 {
+		/* at the same position, voices are kept together so they form separate chords,
+		 * and each voice's rests go before its notes */
+		if note.Voice != note2.Voice {
+			return int(note.Voice) - int(note2.Voice)
+		}
+		if note.Rest != note2.Rest {
+			if note.Rest {
+				return -1
+			}
+			return 1
+		}
 		return int(note.Pitch) - int(note2.Pitch)
 	}
 	return d
@@ -152,6 +201,13 @@ func (src *Note) Dup() (dst *Note) {
 	dst.Offset.Set(src.Offset)
 	dst.Pitch = src.Pitch
 	dst.Duration.Set(src.Duration)
+	dst.Spelling = src.Spelling
+	dst.Tied = src.Tied
+	dst.Rest = src.Rest
+	dst.Voice = src.Voice
+	dst.Nudge = src.Nudge
+	dst.Velocity = src.Velocity
+	dst.Articulations = src.Articulations
 	return dst
 }
 
@@ -161,42 +217,96 @@ func (staff *Staff) removeNote(note *Note) bool {
 	if i < len(staff.notes) && note == staff.notes[i] {
 		copy(staff.notes[i:], staff.notes[i+1:])
 		staff.notes = staff.notes[:len(staff.notes) - 1]
+		if int(note.Voice) + 1 == staff.voices {
+			staff.countVoices()
+		}
 		return true
 	}
 	return false
 }
 
 func (score *Score) AddNotes(staff *Staff, notes... *Note) {
-	score.update(&AddNotesOp{staff, notes, make(map[*Note]*big.Rat)})
+	score.update(&AddNotesOp{staff: staff, notes: notes, origDur: make(map[*Note]*big.Rat)})
 }
 
 type AddNotesOp struct {
 	staff *Staff
 	notes []*Note
 	origDur map[*Note]*big.Rat
+	orig []notePos
+	ext extension
 }
 
 func (op *AddNotesOp) apply(score *Score) interface{} {
-	for _, note := range op.notes {
+	op.orig = make([]notePos, len(op.notes))
+	for i, note := range op.notes {
+		op.orig[i] = posOf(note)
+		score.extend(note, &op.ext)
 		if existing := op.staff.NoteAt(note); existing != nil {
 			op.origDur[note] = big.NewRat(1, 1)
 			op.origDur[note].Set(existing.Duration)
 		}
 	}
 	op.staff.addNote(op.notes...)
-	return staffChanged(op.staff)
+	return extendChanged(&op.ext, staffChanged(op.staff))
 }
 
 func (op *AddNotesOp) undo(score *Score) {
-	for _, note := range op.notes {
+	for i, note := range op.notes {
 		if !op.staff.removeNote(note) {
 			op.staff.NoteAt(note).Duration.Set(op.origDur[note])
 		}
+		op.orig[i].restore(note)
+	}
+	score.unextend(&op.ext)
+}
+
+/* notePos remembers where a note was before an op extended or moved it */
+type notePos struct {
+	beat *BeatRef
+	offset big.Rat
+	pitch uint8
+	spelling *Spelling
+}
+
+func posOf(note *Note) notePos {
+	pos := notePos{beat: note.Beat, pitch: note.Pitch, spelling: note.Spelling}
+	pos.offset.Set(note.Offset)
+	return pos
+}
+
+func (pos *notePos) restore(note *Note) {
+	note.Beat = pos.beat
+	note.Offset.Set(&pos.offset)
+	note.Pitch = pos.pitch
+	note.Spelling = pos.spelling
+}
+
+func extendChanged(x *extension, change StaffChanged) interface{} {
+	if x.n > 0 {
+		return changes{change, BeatChanged{}}
 	}
+	return change
+}
+
+type noteList []*Note
+
+func (l noteList) Len() int { return len(l) }
+func (l noteList) Less(i, j int) bool { return l[i].Cmp(l[j]) < 0 }
+func (l noteList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+/* SortNotes orders 'notes' by position then pitch, as a staff keeps them */
+func SortNotes(notes []*Note) {
+	sort.Sort(noteList(notes))
 }
 
 func (staff *Staff) addNote(note... *Note) {
 	staff.notes = Merge(staff.notes, note...)
+	for _, n := range note {
+		if int(n.Voice) >= staff.voices {
+			staff.voices = int(n.Voice) + 1
+		}
+	}
 }
 
 /* Merges 'notes' into the already-sorted 'list'. */
@@ -223,47 +333,115 @@ func Merge(list []*Note, notes... *Note) []*Note {
 }
 
 func (score *Score) MvNotes(Δpitch int8, Δbeat *big.Rat, notes... StaffNote) {
-	score.update(&MvNotesOp{Δpitch, Δbeat, notes})
+	score.update(&MvNotesOp{Δpitch: Δpitch, Δbeat: Δbeat, notes: notes})
 }
 
 type MvNotesOp struct {
 	Δpitch int8
 	Δbeat *big.Rat
 	notes []StaffNote
+	orig []notePos
+	ext extension
 }
 
 func (op *MvNotesOp) apply(score *Score) interface{} {
-	op.mv(op.Δpitch, op.Δbeat)
-	return notesChanged(op.notes)
+	op.orig = make([]notePos, len(op.notes))
+	for i, sn := range op.notes {
+		sn.Staff.removeNote(sn.Note)
+		op.orig[i] = posOf(sn.Note)
+	}
+	for _, sn := range op.notes {
+		sn.Note.Mv(op.Δpitch, op.Δbeat)
+		score.extend(sn.Note, &op.ext)
+		sn.Staff.addNote(sn.Note)
+	}
+	return extendChanged(&op.ext, notesChanged(op.notes))
 }
 
-func (op *MvNotesOp) mv(Δpitch int8, Δbeat *big.Rat) {
+func (op *MvNotesOp) undo(score *Score) {
+	// XXX if addNote modified Duration of any notes, that is not restored
 	for _, sn := range op.notes {
 		sn.Staff.removeNote(sn.Note)
 	}
+	for i, sn := range op.notes {
+		op.orig[i].restore(sn.Note)
+		sn.Staff.addNote(sn.Note)
+	}
+	score.unextend(&op.ext)
+}
+
+/* SetVoice moves 'notes' into the given voice of their staves */
+func (score *Score) SetVoice(voice uint8, notes... StaffNote) bool {
+	return score.update(&SetVoiceOp{voice: voice, notes: notes})
+}
+
+type SetVoiceOp struct {
+	voice uint8
+	notes []StaffNote
+	orig []uint8
+}
+
+func (op *SetVoiceOp) apply(score *Score) interface{} {
+	op.orig = make([]uint8, len(op.notes))
+	changed := false
+	/* voice affects the order of notes, so take them out while changing it */
+	for i, sn := range op.notes {
+		sn.Staff.removeNote(sn.Note)
+		op.orig[i] = sn.Note.Voice
+		changed = changed || sn.Note.Voice != op.voice
+		sn.Note.Voice = op.voice
+	}
 	for _, sn := range op.notes {
-		sn.Note.Mv(Δpitch, Δbeat)
 		sn.Staff.addNote(sn.Note)
 	}
+	if !changed {
+		return nil
+	}
+	return notesChanged(op.notes)
 }
 
-func (op *MvNotesOp) undo(score *Score) {
-	// XXX if addNote modified Duration of any notes, that is not restored
-	op.mv(-op.Δpitch, (&big.Rat{}).Neg(op.Δbeat))
+func (op *SetVoiceOp) undo(score *Score) {
+	for _, sn := range op.notes {
+		sn.Staff.removeNote(sn.Note)
+	}
+	for i, sn := range op.notes {
+		sn.Note.Voice = op.orig[i]
+		sn.Staff.addNote(sn.Note)
+	}
+}
+
+/* Voices returns the number of voices in use on the staff */
+func (staff *Staff) Voices() int {
+	return staff.voices
+}
+
+func (staff *Staff) countVoices() {
+	n := 0
+	for _, note := range staff.notes {
+		if int(note.Voice) >= n {
+			n = int(note.Voice) + 1
+		}
+	}
+	staff.voices = n
 }
 
 // needs to clip resulting pitch/beat
+/* Moving a note past the first or last beat leaves its offset outside [0, 1).
+ * An explicit spelling survives octave transposition but nothing else. */
 func (note *Note) Mv(Δpitch int8, Δbeat *big.Rat) *Note {
 	note.Pitch += uint8(Δpitch)
+	if Δpitch % 12 != 0 {
+		note.Spelling = nil
+	}
 	note.Offset.Add(note.Offset, Δbeat)
 	f, _ := note.Offset.Float64()
-	for f > 1.0 {
-		note.Beat = note.Beat.LNext()
+	for f > 1.0 && note.Beat.next != nil {
+		note.Beat = note.Beat.next
 		f -= 1.0;
 		note.Offset.Sub(note.Offset, big.NewRat(1, 1))
 	}
-	for f < 0.0 {
-		note.Beat = note.Beat.LPrev()
+	for f < 0.0 && note.Beat.prev != nil {
+		note.Beat = note.Beat.prev
 		f += 1.0;
 		note.Offset.Add(note.Offset, big.NewRat(1, 1))
 	}
@@ -295,8 +473,14 @@ type RepeatNotesOp struct {
 func (op *RepeatNotesOp) apply(score *Score) interface{} {
 	rng := op.rng
 	dest := op.rng.Last
+	if score.BarPos(rng.First).IsDownbeat() {
+		/* a phrase starting on a bar line is repeated from the next bar line */
+		if db := score.NextDownbeat(dest); db != nil {
+			dest = db
+		}
+	}
 	n := rng.Last.Subtract(rng.First)
-	if extra := rng.Last.Walk(n).Subtract(rng.Last); extra < n {
+	if extra := dest.Walk(n).Subtract(dest); extra < n {
 		/* truncate the source range so we don't go past the defined beats */
 		rng = BeatRange{rng.First, rng.Last.Walk(extra - n)}
 	}
@@ -355,12 +539,18 @@ func (staff *Staff) Key() KeySig {
 	return staff.nsharps
 }
 
+func (staff *Staff) Mode() Mode {
+	return staff.mode
+}
+
 func (staff *Staff) Notes() []*Note {
 	return staff.notes
 }
 
-func (staff *Staff) KeyAccidentalLines() (KeySig, []int) {
-	return staff.nsharps, staff.clef.accidentalLines(staff.nsharps)
+/* returns the key in effect at 'beat' and the lines of its accidentals */
+func (staff *Staff) KeyAccidentalLines(beat *BeatRef) (KeySig, []int) {
+	key, _ := staff.WrittenKeyAt(beat)
+	return key, staff.clef.accidentalLines(key)
 }
 
 type NoteIter func()(StaffNote, NoteIter)
@@ -409,6 +599,7 @@ func (score *Score) Iter(rng TimeRange, staves... *Staff) NoteIter {
 
 type ChordIter func()([]StaffNote, ChordIter)
 
+/* Chords groups notes which start together on the same staff and in the same voice */
 func Chords(notes NoteIter) ChordIter {
 	if notes == nil {
 		return nil
@@ -419,7 +610,8 @@ func Chords(notes NoteIter) ChordIter {
 	nextChord = func()([]StaffNote, ChordIter) {
 		for nextNote != nil {
 			sn, nextNote = nextNote()
-			if chord[0].Note.Beat == sn.Note.Beat && chord[0].Note.Offset.Cmp(sn.Note.Offset) == 0 {
+			first := chord[0]
+			if first.Staff == sn.Staff && first.Note.Voice == sn.Note.Voice && first.Note.Beat == sn.Note.Beat && first.Note.Offset.Cmp(sn.Note.Offset) == 0 {
 				chord = append(chord, sn)
 			} else {
 				result := chord
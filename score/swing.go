@@ -0,0 +1,117 @@
+package score
+
+import (
+	"math/big"
+)
+
+/* A swung staff is written in straight eighths, but plays the second eighth of each beat
+ * late, as is usual in jazz and blues. The swing is the point within the beat where the
+ * second eighth sounds: 1/2 for straight, 2/3 for a triplet feel. Positions in the first
+ * half of the beat are stretched to fit before it, and those in the second half squeezed
+ * after it. Tuplets are left alone, as they are already written the way they sound. */
+
+/* Swings lists the usual amounts of swing, from straight to a hard 3:1 shuffle */
+var Swings []float64 = []float64{0.5, 0.6, 2.0 / 3, 0.75}
+
+/* Swing returns the point within a beat where the staff's offbeat eighths sound */
+func (staff *Staff) Swing() float64 {
+	if staff.swing == 0 {
+		return 0.5
+	}
+	return staff.swing
+}
+
+/* LoadSwing sets the swing of a staff which hasn't been added to the score yet */
+func (score *Score) LoadSwing(staff *Staff, swing float64) {
+	staff.swing = swing
+}
+
+/* swung returns the sounding position of the written fraction of a beat 'α' */
+func (staff *Staff) swung(α float64) float64 {
+	s := staff.Swing()
+	if α <= 0.5 {
+		return α * 2 * s
+	}
+	return s + (α - 0.5) * 2 * (1 - s)
+}
+
+/* unswung is the inverse of swung */
+func (staff *Staff) unswung(α float64) float64 {
+	s := staff.Swing()
+	if α <= s {
+		return α / s / 2
+	}
+	return 0.5 + (α - s) / (1 - s) / 2
+}
+
+/* swungRat is like swung, but leaves positions which aren't straight subdivisions of the
+ * beat in place */
+func (staff *Staff) swungRat(offset *big.Rat) float64 {
+	f, _ := offset.Float64()
+	if staff.swing == 0 || !straight(offset.Denom()) {
+		return f
+	}
+	whole := float64(int64(f))
+	return whole + staff.swung(f - whole)
+}
+
+/* straight returns true if 'denom' is a power of two */
+func straight(denom *big.Int) bool {
+	return denom.BitLen() - 1 == int(denom.TrailingZeroBits())
+}
+
+/* SoundingBeatf is like Score.Beatf, but gives the position at which the note sounds */
+func (staff *Staff) SoundingBeatf(note *Note) BeatPoint {
+	return BeatPt{note.Beat, staff.swungRat(note.Offset)}
+}
+
+/* SoundingEndBeatf is like Score.EndBeatf, but gives the position at which the note stops
+ * sounding */
+func (staff *Staff) SoundingEndBeatf(note *Note) BeatPoint {
+	one := big.NewRat(1, 1)
+	r := new(big.Rat).Add(note.Offset, note.Duration)
+	b := note.Beat
+	for r.Cmp(one) > 0 && b.next != nil {
+		b = b.next
+		r.Sub(r, one)
+	}
+	return BeatPt{b, staff.swungRat(r)}
+}
+
+/* Unswing returns the written position of a point heard on the staff, eg. an onset found
+ * in the audio, ready for quantizing */
+func (staff *Staff) Unswing(pt BeatPoint) BeatPoint {
+	α := pt.Offsetf()
+	if staff.swing == 0 || α < 0 || α >= 1 {
+		return pt
+	}
+	return BeatPt{pt.Beat(), staff.unswung(α)}
+}
+
+/* SetSwing changes the swing of 'staff'. The notes are written the same, but play back
+ * differently. */
+func (score *Score) SetSwing(staff *Staff, swing float64) bool {
+	if swing == 0.5 {
+		swing = 0
+	}
+	return score.update(&SetSwingOp{staff: staff, swing: swing})
+}
+
+type SetSwingOp struct {
+	staff *Staff
+	swing float64
+	orig float64
+}
+
+func (op *SetSwingOp) apply(score *Score) interface{} {
+	op.orig = op.staff.swing
+	if op.orig == op.swing {
+		return nil
+	}
+	op.staff.swing = op.swing
+	return staffChanged(op.staff)
+}
+
+func (op *SetSwingOp) undo(score *Score) {
+	op.staff.swing = op.orig
+}
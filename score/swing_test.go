@@ -0,0 +1,45 @@
+package score
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestSwing(t *testing.T) {
+	b0 := &BeatRef{frame: 0}
+	b1 := &BeatRef{frame: 100, prev: b0}
+	b0.next = b1
+	staff := MkStaff("", &TrebleClef, 0, Major)
+	staff.swing = 2.0 / 3
+	cases := []struct {
+		offset *big.Rat
+		expected float64
+	}{
+		{big.NewRat(0, 1), 0},
+		{big.NewRat(1, 2), 2.0 / 3},
+		{big.NewRat(1, 4), 1.0 / 3},
+		{big.NewRat(3, 4), 5.0 / 6},
+		{big.NewRat(1, 3), 1.0 / 3}, // triplets are left alone
+	}
+	for _, c := range cases {
+		note := &Note{Pitch: 60, Duration: big.NewRat(1, 2), Beat: b0, Offset: c.offset}
+		if α := staff.SoundingBeatf(note).Offsetf(); math.Abs(α - c.expected) > 1e-9 {
+			t.Errorf("%v sounded at %v; expected %v", c.offset, α, c.expected)
+		}
+		if c.offset.Denom().Int64() != 3 {
+			if α := staff.Unswing(BeatPt{b0, c.expected}).Offsetf(); math.Abs(α - ratf(c.offset)) > 1e-9 {
+				t.Errorf("unswinging %v gave %v; expected %v", c.expected, α, c.offset)
+			}
+		}
+	}
+	end := staff.SoundingEndBeatf(&Note{Pitch: 60, Duration: big.NewRat(1, 2), Beat: b0, Offset: big.NewRat(1, 2)})
+	if end.Beat() != b0 || end.Offsetf() != 1 {
+		t.Errorf("an offbeat eighth should sound until the next beat; got %v", end)
+	}
+}
+
+func ratf(r *big.Rat) float64 {
+	f, _ := r.Float64()
+	return f
+}
@@ -0,0 +1,120 @@
+package score
+
+import (
+	"math/big"
+	"sort"
+)
+
+func (staff *Staff) indexOf(note *Note) int {
+	searchFn := func(i int)bool { return note.Cmp(staff.notes[i]) <= 0 }
+	i := sort.Search(len(staff.notes), searchFn)
+	if i < len(staff.notes) && staff.notes[i] == note {
+		return i
+	}
+	return -1
+}
+
+/* endPos returns where 'note' finishes, with the offset brought within [0, 1) where
+ * there are beats to carry it into */
+func (note *Note) endPos() (*BeatRef, *big.Rat) {
+	one := big.NewRat(1, 1)
+	b, r := note.Beat, new(big.Rat).Add(note.Offset, note.Duration)
+	for r.Cmp(one) >= 0 && b.next != nil {
+		b = b.next
+		r.Sub(r, one)
+	}
+	return b, r
+}
+
+/* cmpPos orders 'note' against the position 'beat' + 'offset' */
+func (note *Note) cmpPos(beat *BeatRef, offset *big.Rat) int {
+	if note.Beat.frame != beat.frame {
+		if note.Beat.frame < beat.frame {
+			return -1
+		}
+		return 1
+	}
+	return note.Offset.Cmp(offset)
+}
+
+/* TiedTo returns the note that 'note' is tied into - a note of the same pitch in the same
+ * voice starting just as it ends - or nil if it isn't tied. */
+func (staff *Staff) TiedTo(note *Note) *Note {
+	i := staff.indexOf(note)
+	if !note.Tied || note.Rest || i == -1 {
+		return nil
+	}
+	beat, offset := note.endPos()
+	for _, next := range staff.notes[i+1:] {
+		if d := next.cmpPos(beat, offset); d > 0 {
+			break
+		} else if d < 0 {
+			continue
+		}
+		if !next.Rest && next.Pitch == note.Pitch && next.Voice == note.Voice {
+			return next
+		}
+	}
+	return nil
+}
+
+/* TiedFrom returns the note which is tied into 'note', or nil if it starts afresh. */
+func (staff *Staff) TiedFrom(note *Note) *Note {
+	i := staff.indexOf(note)
+	if note.Rest || i == -1 {
+		return nil
+	}
+	/* only the previous note of the same pitch and voice can be tied in, and only if it
+	 * ends where this one starts */
+	for j := i - 1; j >= 0; j-- {
+		prev := staff.notes[j]
+		if !prev.Rest && prev.Pitch == note.Pitch && prev.Voice == note.Voice {
+			if beat, offset := prev.endPos(); prev.Tied && note.cmpPos(beat, offset) == 0 {
+				return prev
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+/* LastTied follows the ties from 'note' and returns the note where the sound ends */
+func (staff *Staff) LastTied(note *Note) *Note {
+	seen := map[*Note]bool{note: true}
+	for next := staff.TiedTo(note); next != nil && !seen[next]; next = staff.TiedTo(next) {
+		seen[next] = true
+		note = next
+	}
+	return note
+}
+
+/* TieNotes ties each of 'notes' into the next note of the same pitch, or removes the ties
+ * if every one of them is already tied. */
+func (score *Score) TieNotes(notes... StaffNote) {
+	tie := false
+	for _, sn := range notes {
+		tie = tie || !sn.Note.Tied
+	}
+	score.update(&TieNotesOp{notes: notes, tie: tie})
+}
+
+type TieNotesOp struct {
+	notes []StaffNote
+	tie bool
+	orig []bool
+}
+
+func (op *TieNotesOp) apply(score *Score) interface{} {
+	op.orig = make([]bool, len(op.notes))
+	for i, sn := range op.notes {
+		op.orig[i] = sn.Note.Tied
+		sn.Note.Tied = op.tie && !sn.Note.Rest
+	}
+	return notesChanged(op.notes)
+}
+
+func (op *TieNotesOp) undo(score *Score) {
+	for i, sn := range op.notes {
+		sn.Note.Tied = op.orig[i]
+	}
+}
@@ -0,0 +1,57 @@
+package score
+
+import (
+	"math/big"
+	"testing"
+
+	. "github.com/sqweek/sqribe/core/types"
+)
+
+func TestTies(t *testing.T) {
+	beats := mkBeats([]FrameN{0, 100, 200, 300, 400, 500, 600})
+	b := beats.Head
+	note := func(b *BeatRef, pitch uint8, tied, rest bool) *Note {
+		return &Note{Pitch: pitch, Duration: big.NewRat(1, 1), Beat: b, Offset: new(big.Rat), Tied: tied, Rest: rest}
+	}
+	c1 := note(b, 60, true, false)
+	e1 := note(b, 64, true, false)
+	r2 := note(b.next, 60, false, true)
+	c2 := note(b.next, 60, true, false)
+	c3 := note(b.next.next, 60, false, false)
+	g3 := note(b.next.next, 67, false, false)
+	/* a tie doesn't reach a note of the same pitch after a rest or a gap */
+	g4 := note(b.Walk(3), 67, true, false)
+	r5 := note(b.Walk(4), 67, false, true)
+	g6 := note(b.Walk(5), 67, true, false)
+	g6.Duration = big.NewRat(1, 2)
+	g7 := note(b.Walk(6), 67, false, false)
+	staff := MkStaff("", &TrebleClef, 0, Major)
+	staff.addNote(c1)
+	staff.addNote(g3, c3, c2, r2, e1, g4, r5, g6, g7)
+
+	if staff.notes[2] != r2 || staff.notes[3] != c2 {
+		t.Errorf("rest should sort before the note at the same position")
+	}
+	for _, test := range []struct{
+		note, to, from, last *Note
+	}{
+		{c1, c2, nil, c3},
+		{c2, c3, c1, c3},
+		{c3, nil, c2, c3},
+		{e1, nil, nil, e1}, // no later E to tie into
+		{r2, nil, nil, r2},
+		{g4, nil, nil, g4},
+		{g6, nil, nil, g6},
+		{g7, nil, nil, g7},
+	} {
+		if to := staff.TiedTo(test.note); to != test.to {
+			t.Errorf("pitch %d at %d: tied to %v, expected %v", test.note.Pitch, test.note.Beat.frame, to, test.to)
+		}
+		if from := staff.TiedFrom(test.note); from != test.from {
+			t.Errorf("pitch %d at %d: tied from %v, expected %v", test.note.Pitch, test.note.Beat.frame, from, test.from)
+		}
+		if last := staff.LastTied(test.note); last != test.last {
+			t.Errorf("pitch %d at %d: ends at %v, expected %v", test.note.Pitch, test.note.Beat.frame, last, test.last)
+		}
+	}
+}
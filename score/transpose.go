@@ -0,0 +1,122 @@
+package score
+
+/* A transposing staff is written at a different pitch to the one it sounds, eg. a Bb
+ * clarinet sounds a tone lower than written. Notes always hold the sounding (concert)
+ * pitch; only the way they are written changes. */
+
+/* MaxTransposition bounds how far a staff can be transposed either way */
+const MaxTransposition = 24
+
+/* ClampTransposition limits 'semitones' to within MaxTransposition of concert pitch */
+func ClampTransposition(semitones int) int {
+	if semitones > MaxTransposition {
+		return MaxTransposition
+	} else if semitones < -MaxTransposition {
+		return -MaxTransposition
+	}
+	return semitones
+}
+
+/* Transposition returns the semitones to add to the staff's written pitches to get the
+ * sounding pitches, eg. -2 for an instrument in Bb */
+func (staff *Staff) Transposition() int {
+	return staff.transpose
+}
+
+/* LoadTransposition sets the transposition of a staff which hasn't been added to the score
+ * yet */
+func (score *Score) LoadTransposition(staff *Staff, semitones int) {
+	staff.transpose = ClampTransposition(semitones)
+}
+
+/* Transpose returns the key signature of the same key moved up by 'semitones', preferring
+ * keys with no more than six sharps or flats */
+func (key KeySig) Transpose(semitones int) KeySig {
+	fifths := (semitones * 7) % 12 // each semitone is seven steps round the circle of fifths
+	if fifths < 0 {
+		fifths += 12
+	}
+	if fifths == 0 {
+		return key
+	}
+	shifted := int(key) + fifths
+	if shifted > 6 {
+		shifted -= 12
+	}
+	return KeySig(shifted)
+}
+
+/* Diatonic returns the number of letter names a transposition of 'semitones' moves
+ * through, eg. -1 for an instrument in Bb and -4 for one in F */
+func Diatonic(semitones int) int {
+	steps := []int{0, 1, 1, 2, 2, 3, 3, 4, 5, 5, 6, 6}
+	n := semitones
+	if n < 0 {
+		n = -n
+	}
+	d := steps[n % 12] + 7 * (n / 12)
+	if semitones < 0 {
+		return -d
+	}
+	return d
+}
+
+/* WrittenKeyAt is like KeyAt, but gives the key as written on a transposing staff */
+func (staff *Staff) WrittenKeyAt(beat *BeatRef) (KeySig, Mode) {
+	key, mode := staff.KeyAt(beat)
+	if staff.transpose == 0 || staff.clef.drums {
+		return key, mode
+	}
+	return key.Transpose(-staff.transpose), mode
+}
+
+/* written returns the pitch at which concert pitch 'pitch' is written on the staff */
+func (staff *Staff) written(pitch uint8) uint8 {
+	if staff.clef.drums {
+		return pitch
+	}
+	return clampPitch(int(pitch) - staff.transpose)
+}
+
+/* concert returns the sounding pitch of written pitch 'pitch' */
+func (staff *Staff) concert(pitch uint8) uint8 {
+	if staff.clef.drums {
+		return pitch
+	}
+	return clampPitch(int(pitch) + staff.transpose)
+}
+
+/* clampPitch brings 'pitch' within the midi range, for notes transposed off either end */
+func clampPitch(pitch int) uint8 {
+	if pitch < 0 {
+		return 0
+	} else if pitch > 127 {
+		return 127
+	}
+	return uint8(pitch)
+}
+
+/* SetTransposition changes the transposition of 'staff'. The notes keep sounding at the
+ * same pitch, and are rewritten. */
+func (score *Score) SetTransposition(staff *Staff, semitones int) bool {
+	return score.update(&SetTranspositionOp{staff: staff, semitones: ClampTransposition(semitones)})
+}
+
+type SetTranspositionOp struct {
+	staff *Staff
+	semitones int
+	orig int
+}
+
+func (op *SetTranspositionOp) apply(score *Score) interface{} {
+	op.orig = op.staff.transpose
+	if op.orig == op.semitones {
+		return nil
+	}
+	op.staff.transpose = op.semitones
+	return KeyChanged(staffChanged(op.staff))
+}
+
+func (op *SetTranspositionOp) undo(score *Score) {
+	op.staff.transpose = op.orig
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/sqweek/sqribe/midi"
+	"github.com/sqweek/sqribe/score"
+
+	. "github.com/sqweek/sqribe/core/types"
+)
+
+const ppq = 480 // ticks per quarter note
+
+/* smfTicks lays the beats out in midi ticks. Each beat spans a 1/Unit note of the time
+ * signature in effect, and the first beat is preceded by a quarter note lead-in covering
+ * the audio before it. */
+type smfTicks struct {
+	lead int
+	ticks map[*score.BeatRef]int // tick at which each beat starts
+	beatTicks map[*score.BeatRef]int // length of each beat in ticks
+}
+
+func mkSmfTicks(sc *score.Score) *smfTicks {
+	tm := smfTicks{ticks: make(map[*score.BeatRef]int), beatTicks: make(map[*score.BeatRef]int)}
+	if sc.Head.Frame() > 0 {
+		tm.lead = ppq
+	}
+	tick := tm.lead
+	for b := sc.Head; b != nil; b = b.Next() {
+		tm.ticks[b] = tick
+		tm.beatTicks[b] = ppq * 4 / sc.TimeSigAt(b).Unit
+		tick += tm.beatTicks[b]
+	}
+	return &tm
+}
+
+func (tm *smfTicks) at(beat *score.BeatRef, offset *big.Rat) int {
+	r := new(big.Rat).Set(offset)
+	one := rat(1, 1)
+	for r.Cmp(one) >= 0 && beat.Next() != nil {
+		r.Sub(r, one)
+		beat = beat.Next()
+	}
+	return tm.ticks[beat] + dur2ticks(r, tm.beatTicks[beat])
+}
+
+/* ExportSMF writes a type 1 midi file with a conductor track carrying the tempo map,
+ * followed by one track per staff. */
+func ExportSMF(filename string) error {
+	sc, wav := G.score, G.wav
+	if wav == nil || !sc.HasBeats() {
+		return fmt.Errorf("nothing to export; the score has no beats")
+	}
+	tm := mkSmfTicks(sc)
+	smf := midi.SMF{Format: 1, Division: ppq}
+	smf.Tracks = append(smf.Tracks, smfConductor(sc, tm))
+	for i, staff := range sc.Staves() {
+		ch := uint8(i % 15)
+		if ch >= midi.ChanDrums {
+			ch++ // leave the percussion channel alone
+		}
+		if staff.Clef().IsPercussion() {
+			ch = midi.ChanDrums
+		}
+		smf.Tracks = append(smf.Tracks, smfStaff(staff, ch, tm))
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = smf.Write(file)
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func smfConductor(sc *score.Score, tm *smfTicks) *midi.Track {
+	track := &midi.Track{}
+	track.Meta(0, midi.MetaTrackName, []byte("sqribe")...)
+	keySig := func(tick int, key score.KeySig, mode score.Mode) {
+		minor := byte(0)
+		if mode == score.Minor {
+			minor = 1
+		}
+		track.Meta(tick, midi.MetaKeySig, byte(int8(key)), minor)
+	}
+	keySig(0, sc.Key(), sc.Mode())
+	if tuning := Synth.Tuning(); tuning != 0 {
+		track.Meta(0, midi.MetaText, []byte(fmt.Sprintf("tuning %+.0f cents", tuning))...)
+	}
+	tempo := func(tick int, frames FrameN, ticks int) {
+		µs := float64(G.wav.TimeAtFrame(frames).Nanoseconds()) / 1000.0
+		perQuarter := int(µs * ppq / float64(ticks) + 0.5)
+		if perQuarter > 0xffffff {
+			perQuarter = 0xffffff
+		}
+		track.Meta(tick, midi.MetaTempo, byte(perQuarter >> 16), byte(perQuarter >> 8), byte(perQuarter))
+	}
+	if tm.lead > 0 {
+		tempo(0, sc.Head.Frame(), tm.lead)
+	}
+	for b := sc.Head; b != nil; b = b.Next() {
+		if b == sc.Head || sc.TimeSigChangeAt(b) != nil {
+			ts := sc.TimeSigAt(b)
+			dd := byte(math.Log2(float64(ts.Unit)))
+			track.Meta(tm.ticks[b], midi.MetaTimeSig, byte(ts.Beats), dd, byte(96 / ts.Unit), 8)
+		}
+		if staves := sc.Staves(); len(staves) > 0 {
+			/* midi has a single key signature, so follow the first staff */
+			if kc := staves[0].KeySigChangeAt(b); kc != nil {
+				keySig(tm.ticks[b], kc.KeySig, kc.Mode)
+			}
+		}
+		if next := b.Next(); next != nil {
+			tempo(tm.ticks[b], next.Frame() - b.Frame(), tm.beatTicks[b])
+		}
+	}
+	return track
+}
+
+func smfStaff(staff *score.Staff, ch uint8, tm *smfTicks) *midi.Track {
+	mix := Mixer.For(staff)
+	track := &midi.Track{}
+	track.Meta(0, midi.MetaTrackName, []byte(midi.InstName(Mixer.Inst(staff)))...)
+	if ch != midi.ChanDrums {
+		track.Add(0, midi.ProgramChange(ch, uint8(mix.Voice))...)
+	}
+	if tuning := Synth.Tuning(); tuning != 0 && ch != midi.ChanDrums {
+		/* set the pitch bend range to +/- 2 semitones, then bend by the tuning offset */
+		track.Add(0, midi.ControlChange(ch, 101, 0)...)
+		track.Add(0, midi.ControlChange(ch, 100, 0)...)
+		track.Add(0, midi.ControlChange(ch, 6, 2)...)
+		track.Add(0, midi.ControlChange(ch, 38, 0)...)
+		bend := int(math.Floor(tuning / 200.0 * 8192 + 0.5))
+		if bend < -8192 {
+			bend = -8192
+		} else if bend > 8191 {
+			bend = 8191
+		}
+		track.Add(0, midi.PitchBend(ch, bend)...)
+	}
+	for _, note := range staff.Notes() {
+		if note.Rest || staff.TiedFrom(note) != nil {
+			continue
+		}
+		last := staff.LastTied(note)
+		end := new(big.Rat).Add(last.Offset, last.Duration)
+		t0, t1 := tm.at(note.Beat, note.Offset), tm.at(last.Beat, end)
+		if scale := note.Articulations.LengthScale(); scale != 1 {
+			t1 = t0 + int(float64(t1 - t0) * scale)
+		}
+		dynamic := staff.DynamicScale(G.score.Beatf(note)) * note.Articulations.VelocityScale()
+		track.Add(t0, midi.NoteOn(ch, note.Pitch, velocity(mix, note.Velocity, dynamic))...)
+		track.Add(t1, midi.NoteOff(ch, note.Pitch)...)
+	}
+	return track
+}
+
+/* smfPos implements score.BeatPoint for positions derived from midi ticks; past the
+ * last beat the offset exceeds 1, and the score extrapolates. */
+type smfPos struct {
+	beat *score.BeatRef
+	α float64
+}
+
+func (pos smfPos) Beat() *score.BeatRef {
+	return pos.beat
+}
+
+func (pos smfPos) Offsetf() float64 {
+	return pos.α
+}
+
+/* smfGrid locates the beats of a midi file, according to its time signatures */
+type smfGrid struct {
+	ticks []int // tick at which each beat starts, plus one past the last
+	sigs map[int]score.TimeSig // beat index -> time signature starting there
+}
+
+func mkSmfGrid(smf *midi.SMF, lastTick int) (*smfGrid, error) {
+	grid := smfGrid{sigs: make(map[int]score.TimeSig)}
+	sigs := smf.TimeSigs()
+	unit := 4
+	for tick := 0; len(grid.ticks) == 0 || grid.ticks[len(grid.ticks) - 1] <= lastTick; {
+		for len(sigs) > 0 && sigs[0].Tick <= tick {
+			if sigs[0].Beats > 0 && sigs[0].Unit > 0 {
+				unit = sigs[0].Unit
+				grid.sigs[len(grid.ticks)] = score.TimeSig{Beats: sigs[0].Beats, Unit: sigs[0].Unit}
+			}
+			sigs = sigs[1:]
+		}
+		grid.ticks = append(grid.ticks, tick)
+		step := smf.Division * 4 / unit
+		if step <= 0 {
+			return nil, fmt.Errorf("1/%d beats are too short for %d ticks per quarter note", unit, smf.Division)
+		}
+		tick += step
+	}
+	return &grid, nil
+}
+
+/* returns the beat index containing 'tick' and the fraction of the way through it */
+func (grid *smfGrid) locate(tick int) (int, float64) {
+	i := sort.SearchInts(grid.ticks, tick + 1) - 1
+	if i < 0 {
+		return 0, 0
+	}
+	if i + 1 >= len(grid.ticks) {
+		i = len(grid.ticks) - 2
+	}
+	t0, t1 := grid.ticks[i], grid.ticks[i+1]
+	return i, float64(tick - t0) / float64(t1 - t0)
+}
+
+type smfNote struct {
+	start, end int
+	pitch, velocity uint8
+}
+
+type smfNotes []smfNote
+
+func (n smfNotes) Len() int { return len(n) }
+func (n smfNotes) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n smfNotes) Less(i, j int) bool {
+	return n[i].start < n[j].start || (n[i].start == n[j].start && n[i].pitch < n[j].pitch)
+}
+
+/* smfPart collects the notes of one channel of one track */
+type smfPart struct {
+	name string
+	program int
+	drums bool // from the percussion channel
+	notes smfNotes
+}
+
+/* ImportSMF adds a staff for each track/channel of a midi file. If the score already has
+ * beats the file's beats are mapped onto them in order, otherwise beats are created from
+ * the file's tempo map. */
+func ImportSMF(filename string) error {
+	if G.wav == nil {
+		return fmt.Errorf("open an audio file before importing midi")
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	smf, err := midi.ReadSMF(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	parts, lastTick := smfParts(smf)
+	if len(parts) == 0 {
+		return fmt.Errorf("%s contains no notes", filename)
+	}
+	grid, err := mkSmfGrid(smf, lastTick)
+	if err != nil {
+		return err
+	}
+	/* the import is a single step as far as undo is concerned */
+	G.score.Group(func() {
+		err = smfImport(smf, parts, grid)
+	})
+	return err
+}
+
+/* smfImport adds the notes of 'parts' to the score as new staves, first laying beats over
+ * the audio according to the file's tempo if the score has none. */
+func smfImport(smf *midi.SMF, parts []*smfPart, grid *smfGrid) error {
+	sc, wav := G.score, G.wav
+	if !sc.HasBeats() {
+		tempo := smf.TempoMap()
+		frames := make([]FrameN, len(grid.ticks))
+		for i, tick := range grid.ticks {
+			frames[i] = wav.FrameAtTime(tempo.Time(tick))
+		}
+		if err := sc.ReplaceBeats(0, frames[len(frames) - 1], frames); err != nil {
+			return err
+		}
+		i := 0
+		for b := sc.Head; b != nil; b = b.Next() {
+			if ts, ok := grid.sigs[i]; ok {
+				sc.SetTimeSig(b, ts)
+			}
+			i++
+		}
+	}
+	beats := make([]*score.BeatRef, 0)
+	for b := sc.Head; b != nil; b = b.Next() {
+		beats = append(beats, b)
+	}
+	quantize := func(tick int) (*score.BeatRef, *big.Rat) {
+		i, α := grid.locate(tick)
+		if i >= len(beats) {
+			return sc.Quantize(smfPos{sc.Tail, float64(i - len(beats) + 1) + α})
+		}
+		return sc.Quantize(smfPos{beats[i], α})
+	}
+	for _, part := range parts {
+		sort.Sort(part.notes) // a new staff takes its notes in the order given
+		notes := make([]*score.Note, 0, len(part.notes))
+		pitchSum, velSum := 0, 0
+		for _, n := range part.notes {
+			beat, offset := quantize(n.start)
+			endBeat, endOffset := quantize(n.end)
+			dur := Δb(endBeat, endOffset, beat, offset)
+			if dur.Sign() <= 0 {
+				dur = rat(1, 4)
+			}
+			notes = append(notes, &score.Note{Pitch: n.pitch, Duration: dur, Beat: beat, Offset: offset, Velocity: n.velocity})
+			pitchSum += int(n.pitch)
+			velSum += int(n.velocity)
+		}
+		origin := uint8(midi.PitchB5)
+		if pitchSum / len(notes) < midi.PitchC5 {
+			origin = midi.PitchD4
+		}
+		clef := score.FindClef(origin)
+		if part.drums {
+			clef = &score.PercussionClef
+		}
+		staff := score.MkStaff(part.name, clef, sc.Key(), sc.Mode())
+		mix := Mixer.For(staff)
+		mix.Voice = part.program
+		mix.Velocity = velSum / len(notes)
+		/* notes played at the staff's velocity needn't have their own */
+		for _, note := range notes {
+			if int(note.Velocity) == mix.Velocity {
+				note.Velocity = 0
+			}
+		}
+		sc.AddStaff(staff)
+		sc.AddNotes(staff, notes...)
+	}
+	return nil
+}
+
+/* smfParts splits the notes of a midi file by track and channel */
+func smfParts(smf *midi.SMF) ([]*smfPart, int) {
+	parts := make([]*smfPart, 0)
+	lastTick := 0
+	for _, track := range smf.Tracks {
+		var byChan [16]*smfPart
+		programs := [16]int{}
+		sounding := make(map[[2]uint8]midi.Event) // channel, pitch -> note on
+		/* ends the note sounding at 'pitch' on 'ch', if there is one */
+		end := func(ch, pitch uint8, tick int) {
+			on, ok := sounding[[2]uint8{ch, pitch}]
+			if !ok {
+				return
+			}
+			delete(sounding, [2]uint8{ch, pitch})
+			if byChan[ch] == nil {
+				byChan[ch] = &smfPart{name: track.Name(), program: programs[ch], drums: ch == midi.ChanDrums}
+				parts = append(parts, byChan[ch])
+			}
+			byChan[ch].notes = append(byChan[ch].notes, smfNote{on.Tick, tick, pitch, on.Data[2]})
+			if tick > lastTick {
+				lastTick = tick
+			}
+		}
+		for _, ev := range track.Events {
+			ch := ev.Channel()
+			switch {
+			case ev.IsMeta():
+				continue
+			case ev.Status() == 0xc0:
+				programs[ch] = int(ev.Data[1])
+			case ev.IsNoteOn():
+				/* a repeated note-on cuts short the note already sounding */
+				end(ch, ev.Data[1], ev.Tick)
+				sounding[[2]uint8{ch, ev.Data[1]}] = ev
+			case ev.IsNoteOff():
+				end(ch, ev.Data[1], ev.Tick)
+			}
+		}
+	}
+	return parts, lastTick
+}
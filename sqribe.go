@@ -39,11 +39,13 @@ var G struct {
 	mixw *MixWidget
 	instMenu MenuWidget
 	noteMenu MenuWidget
+	meterMenu MenuWidget
 	font struct {
 		luxi *Font
 	}
 	kb struct {
 		shift bool
+		ctrl bool
 	}
 }
 
@@ -255,6 +257,8 @@ func main_child() {
 	G.font.luxi = mustMkFont(MustFind("luxisr.ttf"), 10)
 	G.noteMenu = mkMenu(StringMenuOps{}, "1/16", "1/8", "1/4", "1/2", "1", "2", "3", "4")
 	G.noteMenu.SetDefault("1")
+	G.meterMenu = mkMenu(StringMenuOps{}, score.TimeSig{Beats: 2, Unit: 4}, score.TimeSig{Beats: 3, Unit: 4}, score.CommonTime, score.TimeSig{Beats: 5, Unit: 4}, score.TimeSig{Beats: 6, Unit: 8}, score.TimeSig{Beats: 7, Unit: 8}, score.TimeSig{Beats: 9, Unit: 8}, score.TimeSig{Beats: 12, Unit: 8})
+	G.meterMenu.SetDefault(score.CommonTime)
 	G.instMenu = mkMenu(StringMenuOps{toStr: func(item interface{})string {return midi.InstName(item.(int))}}, midi.InstPiano, midi.InstEPiano, midi.InstGuitar, midi.InstEGuitar, midi.InstViolin, midi.InstHarp, midi.InstVoice)
 
 	Synth, err = SynthInit(audio.SampleRate, MustFind("FluidR3_GM.sf2"))
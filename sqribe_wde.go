@@ -29,6 +29,8 @@ type DragState struct {
 func event(win wde.Window, redraw chan Widget, done chan bool, wg *sync.WaitGroup) {
 	openDlg := dialog.File().Title("sqribe - Open").Filter("Audio Files", "mp3", "ogg", "m4a", "wma", "mov", "mp4", "flv", "wmv").Filter("Sqribe Save", "sqs")
 	exportDlg := dialog.File().Title("sqribe - Export to MusicXML").Filter("MXML Files", "xml", "mxl")
+	midiDlg := dialog.File().Title("sqribe - Export to MIDI").Filter("MIDI Files", "mid", "midi")
+	importDlg := dialog.File().Title("sqribe - Import").Filter("MIDI Files", "mid", "midi").Filter("MXML Files", "xml", "musicxml")
 	events := win.EventChan()
 	defer func() {
 		done <- true
@@ -102,11 +104,15 @@ func event(win wde.Window, redraw chan Widget, done chan bool, wg *sync.WaitGrou
 			switch e.Key {
 			case wde.KeyLeftShift, wde.KeyRightShift:
 				G.kb.shift = true
+			case wde.KeyLeftControl, wde.KeyRightControl:
+				G.kb.ctrl = true
 			}
 		case wde.KeyUpEvent:
 			switch e.Key {
 			case wde.KeyLeftShift, wde.KeyRightShift:
 				G.kb.shift = false
+			case wde.KeyLeftControl, wde.KeyRightControl:
+				G.kb.ctrl = false
 			}
 		case wde.KeyTypedEvent:
 			log.UI.Println("typed", e.Key, e.Glyph, e.Chord)
@@ -115,6 +121,10 @@ func event(win wde.Window, redraw chan Widget, done chan bool, wg *sync.WaitGrou
 				G.ww.ShuntSel(-1)
 			case e.Chord == "shift+right_arrow":
 				G.ww.ShuntSel(1)
+			case e.Chord == "shift+up_arrow":
+				G.ww.CrossStaff(-1)
+			case e.Chord == "shift+down_arrow":
+				G.ww.CrossStaff(1)
 			case e.Chord == "shift+" + wde.KeyInsert, e.Chord == "control+v", e.Key == wde.KeyInsert:
 				G.ww.SetPasteMode(!G.ww.PasteMode())
 			case e.Chord == "shift+" + wde.KeyDelete, e.Chord == "control+x":
@@ -145,6 +155,26 @@ func event(win wde.Window, redraw chan Widget, done chan bool, wg *sync.WaitGrou
 						alert("MXML export failed: %v", err)
 					}
 				}()
+			case e.Chord == "control+m":
+				go func() {
+					f, err := midiDlg.Save()
+					if err == nil {
+						err = ExportSMF(f)
+					}
+					if err != nil && err != dialog.Cancelled {
+						alert("MIDI export failed: %v", err)
+					}
+				}()
+			case e.Chord == "control+i":
+				go func() {
+					f, err := importDlg.Load()
+					if err == nil {
+						err = importFile(f)
+					}
+					if err != nil && err != dialog.Cancelled {
+						alert("import failed: %v", err)
+					}
+				}()
 			case e.Chord == "control+c":
 				G.ww.Snarf()
 				G.ww.SetPasteMode(true)
@@ -158,6 +188,7 @@ func event(win wde.Window, redraw chan Widget, done chan bool, wg *sync.WaitGrou
 				G.mixw.AdjustGain(&Mixer.Midi.Gain, -0.1)
 			case e.Key == wde.KeyEscape:
 				G.ww.SetPasteMode(false)
+				G.ww.RejectSuggestion()
 			case e.Key == wde.KeyLeftArrow:
 				G.ww.Scroll(-0.25)
 			case e.Key == wde.KeyRightArrow:
@@ -167,13 +198,31 @@ func event(win wde.Window, redraw chan Widget, done chan bool, wg *sync.WaitGrou
 			case e.Key == wde.KeyDownArrow:
 				G.ww.Zoom(2.0)
 			case e.Key == wde.KeyF2:
-				G.score.KeyChange(-1)
+				G.ww.ShiftKey(-1, 0)
 			case e.Key == wde.KeyF3:
-				G.score.KeyChange(1)
+				G.ww.ShiftKey(1, 0)
+			case e.Chord == "shift+" + wde.KeyF4:
+				G.ww.ShiftKey(0, -1)
+			case e.Key == wde.KeyF4:
+				G.ww.ShiftKey(0, 1)
+			case e.Key == wde.KeyF7:
+				G.ww.CycleClef(-1)
+			case e.Key == wde.KeyF8:
+				G.ww.CycleClef(1)
+			case e.Chord == "shift+" + wde.KeyF9:
+				G.ww.Transpose(-12)
+			case e.Key == wde.KeyF9:
+				G.ww.Transpose(-1)
+			case e.Chord == "shift+" + wde.KeyF10:
+				G.ww.Transpose(12)
+			case e.Key == wde.KeyF10:
+				G.ww.Transpose(1)
 			case e.Key == wde.KeyF5:
 				Synth.AdjustTuning(-10)
+				G.ww.TuningChanged()
 			case e.Key == wde.KeyF6:
 				Synth.AdjustTuning(10)
+				G.ww.TuningChanged()
 			case e.Key == wde.KeyPrior:
 				G.mixw.AdjustGain(&Mixer.Wave.Gain, 0.1)
 			case e.Key == wde.KeyNext:
@@ -182,12 +231,16 @@ func event(win wde.Window, redraw chan Widget, done chan bool, wg *sync.WaitGrou
 				playToggle()
 			case e.Key == wde.KeyReturn:
 				if f, playing := audio.PlayingFrame(); playing {
-					G.score.AddBeat(f)
+					go tapBeat(f)
 				}
 			case e.Key == wde.KeyDelete:
 				G.score.RemoveNotes(G.ww.SelectedNotes()...)
 			case e.Key == wde.KeyS:
 				save()
+			case e.Chord == "shift+v":
+				G.ww.CycleVoice()
+			case e.Key == wde.KeyV:
+				G.ww.ShowSpectrum(!G.ww.SpectrumShown())
 			case e.Key == wde.KeyT:
 				G.mixw.Toggle(&Mixer.MuteMetronome)
 			case e.Key == wde.KeyA:
@@ -196,10 +249,62 @@ func event(win wde.Window, redraw chan Widget, done chan bool, wg *sync.WaitGrou
 				G.mixw.Toggle(&Mixer.Midi.Muted)
 			case e.Key == wde.KeyQ:
 				go G.score.QuantizeBeats()
+			case e.Chord == "shift+o":
+				go snapNotes(G.ww.SelectedNotes(), true)
+			case e.Key == wde.KeyO:
+				go snapNotes(G.ww.SelectedNotes(), false)
+			case e.Chord == "shift+b":
+				if beats, ok := G.ww.SelectedTimeRange().(score.BeatRange); ok {
+					go snapBeats(beats)
+				}
+			case e.Key == wde.KeyB:
+				go detectBeats(G.ww.SelectedTimeRange())
+			case e.Chord == "shift+n":
+				G.ww.AcceptSuggestion()
+			case e.Key == wde.KeyN:
+				if beats, ok := G.ww.SelectedTimeRange().(score.BeatRange); ok {
+					go suggestNotes(beats, G.ww.StaffAtMouse())
+				}
 			case e.Glyph == "#":
 				G.score.MvNotes(1, &rZero, G.ww.SelectedNotes()...)
 			case e.Glyph == "@":
 				G.score.MvNotes(-1, &rZero, G.ww.SelectedNotes()...)
+			case e.Key == wde.KeyJ:
+				G.ww.ToggleJoin()
+			case e.Chord == "shift+g":
+				G.ww.CycleGrid(-1)
+			case e.Key == wde.KeyG:
+				G.ww.CycleGrid(1)
+			case e.Chord == "shift+w":
+				G.ww.CycleSwing(-1)
+			case e.Key == wde.KeyW:
+				G.ww.CycleSwing(1)
+			case e.Key == wde.KeyE:
+				G.ww.Respell()
+			case e.Glyph == "[":
+				G.ww.AdjustVelocity(-8)
+			case e.Glyph == "]":
+				G.ww.AdjustVelocity(8)
+			case e.Chord == "shift+d":
+				G.ww.CycleDynamic(-1)
+			case e.Key == wde.KeyD:
+				G.ww.CycleDynamic(1)
+			case e.Glyph == "<":
+				G.ww.Hairpin(1)
+			case e.Glyph == ">":
+				G.ww.Hairpin(-1)
+			case e.Glyph == ".":
+				G.score.ToggleArticulation(score.Staccato, G.ww.SelectedNotes()...)
+			case e.Glyph == "^":
+				G.score.ToggleArticulation(score.Accent, G.ww.SelectedNotes()...)
+			case e.Glyph == "-":
+				G.score.ToggleArticulation(score.Tenuto, G.ww.SelectedNotes()...)
+			case e.Key == wde.KeyU:
+				G.score.ToggleArticulation(score.Fermata, G.ww.SelectedNotes()...)
+			case e.Glyph == "~":
+				G.score.TieNotes(G.ww.SelectedNotes()...)
+			case e.Key == wde.KeyR:
+				G.ww.PlaceRest()
 			case e.Chord == "shift+8":
 				G.score.MvNotes(-12, &rZero, G.ww.SelectedNotes()...)
 			case e.Key == wde.Key8:
@@ -302,6 +407,9 @@ func drawstuff(w wde.Window, redraw chan Widget, done chan bool) {
 				if !G.instMenu.Rect().Empty() {
 					G.instMenu.Draw(screen, G.instMenu.Rect())
 				}
+				if !G.meterMenu.Rect().Empty() {
+					G.meterMenu.Draw(screen, G.meterMenu.Rect())
+				}
 				w.FlushImage()
 				merged = 0
 				lastframe = time.Now()
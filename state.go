@@ -22,8 +22,16 @@ type SavedStaff struct {
 	Voice int
 	Velocity int
 	Origin uint8
+	Clef string `json:",omitempty"` // since the percussion clef shares the treble's origin
 	Nsharps int
+	Mode int `json:",omitempty"`
+	Keys []SavedKeySig `json:",omitempty"`
 	Muted bool `json:",omitempty"`
+	Joined bool `json:",omitempty"` // same part as the staff above
+	Transpose int `json:",omitempty"` // semitones from written to sounding pitch
+	Grid string `json:",omitempty"` // quantization grid, empty for the default
+	Swing float64 `json:",omitempty"` // where the offbeat eighth sounds, 0 if straight
+	Dynamics []SavedDynamic `json:",omitempty"`
 	Notes []SavedNote `json:",omitempty"` // use Notestr since V3
 	Notestr []string
 }
@@ -34,6 +42,25 @@ type SavedNote struct {
 	Offset *big.Rat
 }
 
+type SavedTimeSig struct {
+	Beat int
+	Beats int
+	Unit int
+}
+
+type SavedDynamic struct {
+	Beat int
+	Level string `json:",omitempty"` // eg. "mf"
+	Hairpin int `json:",omitempty"` // +1 for a crescendo, -1 for a diminuendo
+	End int `json:",omitempty"` // beat the hairpin runs to
+}
+
+type SavedKeySig struct {
+	Beat int
+	Nsharps int
+	Mode int `json:",omitempty"`
+}
+
 type State interface {
 	Headers() *Headers
 	Restore() // restores this objects state to the memory model
@@ -46,6 +73,7 @@ type stateV3 struct {
 
 	Filename string `json:",omitempty"` // written as header since V2
 	Beats []FrameN
+	TimeSigs []SavedTimeSig `json:",omitempty"`
 	FrameRate int
 	Staves []SavedStaff
 	Tuning float64 `json:",omitempty"`
@@ -67,7 +95,31 @@ func savedNotes(staff *score.Staff, beats []FrameN) []string {
 		}
 		b := big.NewRat(int64(i), 1)
 		b.Add(b, note.Offset)
-		saved = append(saved, fmt.Sprintf("%s %v %v", midi.PitchName(note.Pitch), note.Duration, b))
+		str := fmt.Sprintf("%s %v %v", midi.PitchName(note.Pitch), note.Duration, b)
+		if note.Spelling != nil {
+			str += " " + note.Spelling.String()
+		}
+		if note.Tied {
+			str += " tie"
+		}
+		if note.Rest {
+			str += " rest"
+		}
+		if note.Voice > 0 {
+			str += fmt.Sprintf(" v%d", note.Voice + 1)
+		}
+		if note.Nudge != 0 {
+			str += fmt.Sprintf(" @%+d", note.Nudge)
+		}
+		if note.Velocity != 0 {
+			str += fmt.Sprintf(" vel%d", note.Velocity)
+		}
+		for _, a := range score.Articulations {
+			if note.Articulations.Has(a) {
+				str += " " + a.String()
+			}
+		}
+		saved = append(saved, str)
 	}
 	return saved
 }
@@ -76,70 +128,199 @@ func loadNotes(sc *score.Score, staff *score.Staff, n int, notefn noteFunc, beat
 	notes := make([]*score.Note, 0, n)
 	beat := sc.Head
 	for i := 0; i < n; i++ {
-		pitch, duration, offset, err := notefn(i)
+		note, err := notefn(i)
 		if err != nil {
 			log.FS.Printf("error loading note %d: %v\n", i, err)
 			continue
 		}
-		beatf, _ := offset.Float64()
+		beatf, _ := note.Offset.Float64()
 		bi := int(beatf)
 		for beat.Frame() < beats[bi] {
 			beat = beat.Next()
 		}
-		offset.Sub(offset, big.NewRat(int64(bi), 1))
-		notes = append(notes, &score.Note{pitch, duration, beat, offset})
+		note.Beat = beat
+		note.Offset.Sub(note.Offset, big.NewRat(int64(bi), 1))
+		notes = append(notes, note)
 	}
 	return notes
 }
 
+func savedGrid(staff *score.Staff) string {
+	if staff.Grid() == score.AutoGrid {
+		return ""
+	}
+	return staff.Grid().Name
+}
+
+func savedSwing(staff *score.Staff) float64 {
+	if staff.Swing() == 0.5 {
+		return 0
+	}
+	return staff.Swing()
+}
+
 func savedStaves(score *score.Score, beats []FrameN) []SavedStaff {
 	staves := score.Staves()
 	saved := make([]SavedStaff, 0, len(staves))
 	for _, staff := range staves {
 		notes := savedNotes(staff, beats)
 		mix := Mixer.For(staff)
-		saved = append(saved, SavedStaff{staff.Name(), mix.Voice, mix.Velocity - 100, staff.Clef().Origin, int(staff.Key()), mix.Muted, nil, notes})
+		saved = append(saved, SavedStaff{staff.Name(), mix.Voice, mix.Velocity - 100, staff.Clef().Origin, staff.Clef().Name, int(staff.Key()), int(staff.Mode()), savedKeys(staff), mix.Muted, staff.Joined(), staff.Transposition(), savedGrid(staff), savedSwing(staff), savedDynamics(staff), nil, notes})
+	}
+	return saved
+}
+
+func savedTimeSigs(score *score.Score) []SavedTimeSig {
+	sigs := score.TimeSigs()
+	saved := make([]SavedTimeSig, 0, len(sigs))
+	for _, tc := range sigs {
+		saved = append(saved, SavedTimeSig{tc.Beat.BeatNum() - 1, tc.Beats, tc.Unit})
+	}
+	return saved
+}
+
+func savedKeys(staff *score.Staff) []SavedKeySig {
+	changes := staff.KeySigChanges()
+	saved := make([]SavedKeySig, 0, len(changes))
+	for _, kc := range changes {
+		saved = append(saved, SavedKeySig{kc.Beat.BeatNum() - 1, int(kc.KeySig), int(kc.Mode)})
+	}
+	return saved
+}
+
+func savedDynamics(staff *score.Staff) []SavedDynamic {
+	marks := staff.Dynamics()
+	saved := make([]SavedDynamic, 0, len(marks))
+	for _, dm := range marks {
+		sd := SavedDynamic{Beat: dm.Beat.BeatNum() - 1, Level: dm.Level.String(), Hairpin: dm.Hairpin}
+		if dm.End != nil {
+			sd.End = dm.End.BeatNum() - 1
+		}
+		saved = append(saved, sd)
 	}
 	return saved
 }
 
-type noteFunc func(int)(uint8, *big.Rat, *big.Rat, error)
+func loadDynamics(sc *score.Score, staff *score.Staff, saved []SavedDynamic) {
+	marks := make(map[int]score.DynamicMark)
+	ends := make(map[int]int)
+	for _, sd := range saved {
+		level, ok := score.ParseDynamic(sd.Level)
+		if !ok {
+			log.FS.Printf("staff '%s': ignoring unknown dynamic '%s' at beat %d\n", staff.Name(), sd.Level, sd.Beat)
+		}
+		marks[sd.Beat] = score.DynamicMark{Level: level, Hairpin: sd.Hairpin}
+		if sd.Hairpin != 0 {
+			ends[sd.Beat] = sd.End
+		}
+	}
+	sc.LoadDynamics(staff, marks, ends)
+}
+
+func loadTimeSigs(sc *score.Score, saved []SavedTimeSig) {
+	sigs := make(map[int]score.TimeSig)
+	for _, ts := range saved {
+		if ts.Beats <= 0 || ts.Unit <= 0 {
+			log.FS.Printf("ignoring bad time signature %d/%d at beat %d\n", ts.Beats, ts.Unit, ts.Beat)
+			continue
+		}
+		sigs[ts.Beat] = score.TimeSig{Beats: ts.Beats, Unit: ts.Unit}
+	}
+	sc.LoadTimeSigs(sigs)
+}
 
+/* noteFunc returns the i'th saved note, with Offset counting from the first beat */
+type noteFunc func(int)(*score.Note, error)
+
+/* Notestr is "pitch duration offset", optionally followed by an explicit spelling (eg. "C#"),
+ * "tie", "rest", the voice (eg. "v2"), how many frames it is played from its written
+ * position (eg. "@-120"), its velocity (eg. "vel96") and its articulations (eg. "staccato") */
 func noteFnFromStrings(notes []string) noteFunc {
-	return func(i int)(pitch uint8, dur, off *big.Rat, err error) {
+	return func(i int)(*score.Note, error) {
 		f := strings.Split(notes[i], " ")
-		dur = big.NewRat(-1, 1)
-		off = big.NewRat(-1, 1)
-		if pitch, err = midi.ParsePitch(f[0]); err == nil {
-			if _, ok := dur.SetString(f[1]); ok {
-				if _, ok := off.SetString(f[2]); !ok {
-					err = fmt.Errorf("note '%s': bad offset", notes[i])
+		if len(f) < 3 {
+			return nil, fmt.Errorf("note '%s': too few fields", notes[i])
+		}
+		note := &score.Note{Duration: new(big.Rat), Offset: new(big.Rat)}
+		pitch, err := midi.ParsePitch(f[0])
+		if err != nil {
+			return nil, err
+		}
+		note.Pitch = pitch
+		if _, ok := note.Duration.SetString(f[1]); !ok {
+			return nil, fmt.Errorf("note '%s': bad duration", notes[i])
+		}
+		if _, ok := note.Offset.SetString(f[2]); !ok {
+			return nil, fmt.Errorf("note '%s': bad offset", notes[i])
+		}
+		for _, x := range f[3:] {
+			switch x {
+			case "tie":
+				note.Tied = true
+			case "rest":
+				note.Rest = true
+			default:
+				if a, ok := score.ParseArticulation(x); ok {
+					note.Articulations |= a
+					continue
+				}
+				var v int
+				var nudge int64
+				if n, _ := fmt.Sscanf(x, "v%d", &v); n == 1 && v >= 1 && v <= score.NVoices {
+					note.Voice = uint8(v - 1)
+				} else if n, _ := fmt.Sscanf(x, "@%d", &nudge); n == 1 {
+					note.Nudge = FrameN(nudge)
+				} else if n, _ := fmt.Sscanf(x, "vel%d", &v); n == 1 && v >= 1 && v <= 127 {
+					note.Velocity = uint8(v)
+				} else if sp, ok := score.ParseSpelling(x); ok {
+					note.Spelling = &sp
+				} else {
+					log.FS.Printf("note '%s': ignoring unknown field '%s'\n", notes[i], x)
 				}
-				return
-			} else {
-				err = fmt.Errorf("note '%s': bad duration", notes[i])
 			}
 		}
-		return
+		return note, nil
 	}
 }
 
 func noteFnFromStructs(notes []SavedNote) noteFunc {
-	return func(i int)(pitch uint8, dur, off *big.Rat, err error) {
+	return func(i int)(*score.Note, error) {
 		n := notes[i]
-		return n.Pitch, n.Duration, n.Offset, nil
+		return &score.Note{Pitch: n.Pitch, Duration: n.Duration, Offset: n.Offset}, nil
 	}
 }
 
 // XXX lots of pointless change events while building staves
-func loadStaves(sc *score.Score, saved []SavedStaff, beats []FrameN)  {
+func loadStaves(sc *score.Score, saved []SavedStaff, beats []FrameN, rate int)  {
 	staves := make([]*score.Staff, 0, len(saved))
 	for _, sv := range saved {
-		clef := score.FindClef(sv.Origin)
+		clef := score.ClefNamed(sv.Clef)
+		if clef == nil {
+			clef = score.FindClef(sv.Origin)
+		}
 		if clef == nil {
+			log.FS.Printf("staff '%s': unknown clef '%s' (origin %d), using treble\n", sv.Name, sv.Clef, sv.Origin)
 			clef = &score.TrebleClef
 		}
-		staff := score.MkStaff(sv.Name, clef, score.KeySig(sv.Nsharps))
+		staff := score.MkStaff(sv.Name, clef, score.KeySig(sv.Nsharps), score.Mode(sv.Mode))
+		keys := make(map[int]score.KeySigChange)
+		for _, k := range sv.Keys {
+			keys[k.Beat] = score.KeySigChange{KeySig: score.KeySig(k.Nsharps), Mode: score.Mode(k.Mode)}
+		}
+		sc.LoadKeys(staff, keys)
+		sc.LoadJoined(staff, sv.Joined)
+		sc.LoadTransposition(staff, sv.Transpose)
+		if sv.Grid != "" {
+			if grid := score.GridNamed(sv.Grid); grid != nil {
+				sc.LoadGrid(staff, grid)
+			} else {
+				log.FS.Printf("staff '%s': unknown grid '%s', using default\n", sv.Name, sv.Grid)
+			}
+		}
+		if sv.Swing > 0 && sv.Swing < 1 {
+			sc.LoadSwing(staff, sv.Swing)
+		}
+		loadDynamics(sc, staff, sv.Dynamics)
 		var n int
 		var notefn noteFunc
 		if len(sv.Notestr) > 0 {
@@ -149,7 +330,15 @@ func loadStaves(sc *score.Score, saved []SavedStaff, beats []FrameN)  {
 			n = len(sv.Notes)
 			notefn = noteFnFromStructs(sv.Notes)
 		}
-		sc.AddNotes(staff, loadNotes(sc, staff, n, notefn, beats)...)
+		notes := loadNotes(sc, staff, n, notefn, beats)
+		for _, note := range notes {
+			if note.Nudge != 0 {
+				nudge := []FrameN{note.Nudge}
+				convertFrames(nudge, rate, audio.SampleRate)
+				note.Nudge = nudge[0]
+			}
+		}
+		sc.AddNotes(staff, notes...)
 		staves = append(staves, staff)
 		Mixer.LoadStaff(staff, sv)
 	}
@@ -178,6 +367,7 @@ func CaptureState() State {
 	s.h.Extra["Filename"] = G.files.Audio
 	s.FrameRate = audio.SampleRate
 	s.Beats = G.score.BeatFrames()
+	s.TimeSigs = savedTimeSigs(G.score)
 	s.Staves = savedStaves(G.score, s.Beats)
 	s.Tuning = Synth.Tuning()
 	s.MasterGain = Mixer.Master.Gain - 1.0
@@ -200,7 +390,8 @@ func (s *stateV3) Headers() *Headers {
 func (s *stateV3) Restore() {
 	convertFrames(s.Beats, s.FrameRate, audio.SampleRate)
 	G.score.LoadBeats(s.Beats)
-	loadStaves(G.score, s.Staves, s.Beats)
+	loadTimeSigs(G.score, s.TimeSigs)
+	loadStaves(G.score, s.Staves, s.Beats, s.FrameRate)
 	Synth.SetTuning(s.Tuning)
 	Mixer.Master.Gain = s.MasterGain + 1.0
 	Mixer.Wave.Gain = s.WaveGain + 1.0
@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/sqweek/fluidsynth"
+
+	"github.com/sqweek/sqribe/midi"
 )
 
 type Synthesizer struct {
@@ -38,11 +40,18 @@ func (s *Synthesizer) WriteFrames(buf []int16) {
 	s.fluid.WriteS16(buf, buf[1:], 2, 2)
 }
 
-/* returns the channel allocated for a particular instrument */
+/* returns the channel allocated for a particular instrument. midi.InstDrums always gets
+ * the GM percussion channel, which is never tuned. */
 func (s *Synthesizer) Inst(inst uint8) uint8 {
+	if inst == midi.InstDrums {
+		return midi.ChanDrums
+	}
 	c, ok := s.chans[inst]
 	if !ok {
 		c = uint8(len(s.chans))
+		if c >= midi.ChanDrums {
+			c++ // leave the percussion channel alone
+		}
 		s.chans[inst] = c
 		s.fluid.ProgramChange(c, inst)
 		if s.tuning != 0 {
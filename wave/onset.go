@@ -0,0 +1,177 @@
+package wave
+
+import (
+	"math"
+	"math/cmplx"
+
+	. "github.com/sqweek/sqribe/core/types"
+)
+
+const onsetWindow = 1024 // frames per analysis window; must be a power of two
+const onsetHop = 512 // frames between successive analysis windows
+
+/* Envelope is a function of time sampled every Hop frames, starting at F0. */
+type Envelope struct {
+	F0 FrameN
+	Hop FrameN
+	Rate int // frames per second
+	Vals []float64
+}
+
+func (env *Envelope) Frame(i int) FrameN {
+	return env.F0 + FrameN(i) * env.Hop
+}
+
+/* returns the index of the value nearest to frame f, clipped to the envelope's extent */
+func (env *Envelope) Index(f FrameN) int {
+	i := int((f - env.F0 + env.Hop / 2) / env.Hop)
+	if i < 0 {
+		return 0
+	} else if i >= len(env.Vals) {
+		return len(env.Vals) - 1
+	}
+	return i
+}
+
+func (wav *Waveform) Rate() int {
+	return wav.rate
+}
+
+/* Mono returns frames f0 to fN (inclusive) mixed down to one channel and scaled to [-1, 1].
+ * Frames outside the waveform are zero. Blocks until the frames have been read from disk. */
+func (wav *Waveform) Mono(f0, fN FrameN) []float64 {
+	out := make([]float64, fN - f0 + 1)
+	c0, cN := f0, fN
+	if c0 < 0 {
+		c0 = 0
+	}
+	if last := wav.ToFrame(wav.NSamples) - 1; cN > last {
+		cN = last
+	}
+	const step = 1 << 16 // frames per read; avoids one enormous allocation
+	scale := 1.0 / float64(32768 * wav.Channels)
+	for f := c0; f <= cN; f += step {
+		e := f + step - 1
+		if e > cN {
+			e = cN
+		}
+		samples := wav.Frames(f, e)
+		for i := 0; i + wav.Channels <= len(samples); i += wav.Channels {
+			sum := 0
+			for j := 0; j < wav.Channels; j++ {
+				sum += int(samples[i + j])
+			}
+			out[f - f0 + FrameN(i / wav.Channels)] = float64(sum) * scale
+		}
+	}
+	return out
+}
+
+/* OnsetEnvelope computes the spectral flux of frames f0 to fN; peaks correspond to
+ * note onsets and other transients. The result is normalised to unit variance. */
+func (wav *Waveform) OnsetEnvelope(f0, fN FrameN) *Envelope {
+	n := int((fN - f0) / onsetHop) + 1
+	env := &Envelope{F0: f0, Hop: onsetHop, Rate: wav.rate, Vals: make([]float64, n)}
+	window := hann(onsetWindow)
+	buf := make([]complex128, onsetWindow)
+	prev := make([]float64, onsetWindow / 2)
+	const block = 256 // hops per read
+	for i0 := 0; i0 < n; i0 += block {
+		iN := i0 + block
+		if iN > n {
+			iN = n
+		}
+		mono := wav.Mono(env.Frame(i0) - onsetWindow / 2, env.Frame(iN - 1) + onsetWindow / 2)
+		for i := i0; i < iN; i++ {
+			off := (i - i0) * onsetHop
+			for j := range buf {
+				buf[j] = complex(mono[off + j] * window[j], 0)
+			}
+			fft(buf)
+			flux := 0.0
+			for k := range prev {
+				m := math.Log1p(100 * cmplx.Abs(buf[k]))
+				if d := m - prev[k]; d > 0 {
+					flux += d
+				}
+				prev[k] = m
+			}
+			env.Vals[i] = flux
+		}
+	}
+	env.Vals[0] = 0 // there's no previous window to compare against
+	env.normalise()
+	return env
+}
+
+/* NearestOnset returns the frame of the strongest transient within 'radius' frames
+ * of 'frame', or 'frame' itself if there is no transient nearby. */
+func (wav *Waveform) NearestOnset(frame, radius FrameN) FrameN {
+	context := FrameN(wav.rate) // normalise against a second either side
+	env := wav.OnsetEnvelope(frame - radius - context, frame + radius + context)
+	best, bestI := 0.0, -1
+	for i := env.Index(frame - radius); i <= env.Index(frame + radius); i++ {
+		if env.Vals[i] > best {
+			best, bestI = env.Vals[i], i
+		}
+	}
+	if bestI == -1 {
+		return frame
+	}
+	return env.Frame(bestI)
+}
+
+/* removes the local mean, half-wave rectifies and scales to unit variance */
+func (env *Envelope) normalise() {
+	radius := int(env.Rate) / int(env.Hop) / 2 // half a second either side
+	mean := make([]float64, len(env.Vals))
+	sum := 0.0
+	for i := 0; i < len(env.Vals) + radius; i++ {
+		if i < len(env.Vals) {
+			sum += env.Vals[i]
+		}
+		if i - 2 * radius - 1 >= 0 {
+			sum -= env.Vals[i - 2 * radius - 1]
+		}
+		if j := i - radius; j >= 0 {
+			lo, hi := j - radius, j + radius
+			if lo < 0 {
+				lo = 0
+			}
+			if hi >= len(env.Vals) {
+				hi = len(env.Vals) - 1
+			}
+			mean[j] = sum / float64(hi - lo + 1)
+		}
+	}
+	sum2 := 0.0
+	for i, v := range env.Vals {
+		v = math.Max(v - mean[i], 0)
+		env.Vals[i] = v
+		sum2 += v * v
+	}
+	if sd := math.Sqrt(sum2 / float64(len(env.Vals))); sd > 0 {
+		for i := range env.Vals {
+			env.Vals[i] /= sd
+		}
+	}
+}
+
+/* Peaks returns the frames of local maxima exceeding 'threshold', at least 'gap' frames apart */
+func (env *Envelope) Peaks(threshold float64, gap FrameN) []FrameN {
+	peaks := make([]FrameN, 0)
+	for i, v := range env.Vals {
+		if v < threshold || (i > 0 && env.Vals[i-1] >= v) || (i + 1 < len(env.Vals) && env.Vals[i+1] > v) {
+			continue
+		}
+		f := env.Frame(i)
+		if n := len(peaks); n > 0 && f - peaks[n-1] < gap {
+			if env.Vals[env.Index(peaks[n-1])] >= v {
+				continue
+			}
+			peaks = peaks[:n-1] // this one's stronger; replace the previous peak
+		}
+		peaks = append(peaks, f)
+	}
+	return peaks
+}
@@ -0,0 +1,133 @@
+package wave
+
+import (
+	"math"
+	"math/cmplx"
+
+	. "github.com/sqweek/sqribe/core/types"
+)
+
+const (
+	harmonics = 6 // number of partials considered when estimating pitch salience
+	maxPolyphony = 6
+)
+
+/* magnitudes returns the magnitude spectrum of the window centred on 'mid' */
+func (wav *Waveform) magnitudes(mid FrameN, win []float64) []float64 {
+	n := len(win)
+	mono := wav.Mono(mid - FrameN(n / 2), mid + FrameN(n / 2) - 1)
+	x := make([]complex128, n)
+	for j := range x {
+		x[j] = complex(mono[j] * win[j], 0)
+	}
+	fft(x)
+	mag := make([]float64, n / 2 + 1)
+	for j := range mag {
+		mag[j] = cmplx.Abs(x[j])
+	}
+	return mag
+}
+
+func pitchHz(pitch float64) float64 {
+	return 440.0 * math.Pow(2, (pitch - 69) / 12)
+}
+
+/* DetectPitches returns the pitches from lo to hi which appear to be sounding during
+ * frames f0 to fN, strongest first. */
+func (wav *Waveform) DetectPitches(f0, fN FrameN, lo, hi uint8) []uint8 {
+	win := hann(spectrumWindow)
+	hop := FrameN(spectrumWindow / 4)
+	var avg []float64
+	n := 0
+	for mid := f0 + hop / 2; n == 0 || mid < fN; mid += hop {
+		mag := wav.magnitudes(mid, win)
+		if avg == nil {
+			avg = mag
+		} else {
+			for j := range avg {
+				avg[j] += mag[j]
+			}
+		}
+		n++
+	}
+	for j := range avg {
+		avg[j] /= float64(n)
+	}
+	return pickPitches(avg, wav.rate, lo, hi)
+}
+
+/* pickPitches repeatedly chooses the most salient pitch in the magnitude spectrum 'mag',
+ * then removes its expected partials so they aren't reported as notes in their own right. */
+func pickPitches(mag []float64, rate int, lo, hi uint8) []uint8 {
+	sp := pitchSpectrum{append([]float64(nil), mag...), float64(rate) / float64(2 * (len(mag) - 1)), 0}
+	for p := lo; p <= hi; p++ {
+		sp.floor = math.Max(sp.floor, 0.1 * sp.peak(pitchHz(float64(p))))
+	}
+	pitches := make([]uint8, 0, maxPolyphony)
+	first := 0.0
+	for len(pitches) < maxPolyphony {
+		best, bestSal := -1, 0.0
+		for p := int(lo); p <= int(hi); p++ {
+			if s := sp.salience(pitchHz(float64(p))); s > bestSal {
+				best, bestSal = p, s
+			}
+		}
+		if best == -1 || bestSal < 0.3 * first {
+			break
+		}
+		if first == 0 {
+			first = bestSal
+		}
+		pitches = append(pitches, uint8(best))
+		sp.remove(pitchHz(float64(best)))
+	}
+	return pitches
+}
+
+type pitchSpectrum struct {
+	mag []float64
+	binHz float64
+	floor float64 // fundamentals weaker than this are ignored
+}
+
+/* returns the bins within a quarter tone of 'hz' */
+func (sp *pitchSpectrum) bins(hz float64) (int, int) {
+	b0, bN := int(hz * math.Pow(2, -1.0/24) / sp.binHz), int(math.Ceil(hz * math.Pow(2, 1.0/24) / sp.binHz))
+	if bN >= len(sp.mag) {
+		bN = len(sp.mag) - 1
+	}
+	return b0, bN
+}
+
+func (sp *pitchSpectrum) peak(hz float64) float64 {
+	b0, bN := sp.bins(hz)
+	m := 0.0
+	for b := b0; b <= bN; b++ {
+		m = math.Max(m, sp.mag[b])
+	}
+	return m
+}
+
+/* salience sums the spectrum at the first few harmonics of 'hz' */
+func (sp *pitchSpectrum) salience(hz float64) float64 {
+	if sp.peak(hz) <= sp.floor {
+		return 0
+	}
+	s, w := 0.0, 1.0
+	for h := 1; h <= harmonics; h++ {
+		s += w * sp.peak(float64(h) * hz)
+		w *= 0.8
+	}
+	return s
+}
+
+/* remove subtracts the partials of a note at 'hz', assuming they fall off as 1/h */
+func (sp *pitchSpectrum) remove(hz float64) {
+	a := sp.peak(hz)
+	for h := 1; h <= 2 * harmonics; h++ {
+		b0, bN := sp.bins(float64(h) * hz)
+		for b := b0; b <= bN; b++ {
+			sp.mag[b] = math.Max(sp.mag[b] - a / float64(h), 0)
+		}
+	}
+}
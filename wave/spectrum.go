@@ -0,0 +1,174 @@
+package wave
+
+import (
+	"math"
+	"sync"
+
+	. "github.com/sqweek/sqribe/core/types"
+)
+
+const (
+	spectrumWindow = 8192 // long enough to separate semitones in the bass
+	SpectrumHop = 1024
+	SpectrumLo = 21 // lowest midi pitch analysed (A0)
+	SpectrumHi = 108 // highest midi pitch analysed (C8)
+	spectrumRes = 4 // bins per semitone
+)
+
+/* Spectrum computes a pitch-scaled STFT of a Waveform in the background. Each column
+ * covers SpectrumHop frames and holds log magnitudes in bins spaced a quarter
+ * semitone apart, from SpectrumLo to SpectrumHi (assuming A = 440Hz). */
+type Spectrum struct {
+	wav *Waveform
+	mu sync.Mutex
+	cols map[int][]float32
+	peak float32
+	want struct {
+		i0, iN int
+	}
+	wake chan bool
+	done chan struct{}
+	closed bool
+	listeners []chan int
+	win []float64
+}
+
+func NewSpectrum(wav *Waveform) *Spectrum {
+	s := &Spectrum{wav: wav, cols: make(map[int][]float32), wake: make(chan bool, 1), done: make(chan struct{})}
+	s.listeners = make([]chan int, 0, 2)
+	s.win = hann(spectrumWindow)
+	go s.worker()
+	return s
+}
+
+/* Close stops the background computation. 'wake' stays open since Columns may still
+ * send on it; the worker watches 'done' instead. */
+func (s *Spectrum) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+/* ColumnAt returns the column index covering 'frame' */
+func (s *Spectrum) ColumnAt(frame FrameN) int {
+	return int((frame + SpectrumHop / 2) / SpectrumHop)
+}
+
+/* Columns returns the columns from i0 to iN which have been computed so far; missing
+ * entries are nil. The remainder are computed in the background, superseding any
+ * previously requested range. */
+func (s *Spectrum) Columns(i0, iN int) [][]float32 {
+	cols := make([][]float32, iN - i0 + 1)
+	missing := false
+	s.mu.Lock()
+	for i := range cols {
+		cols[i] = s.cols[i0 + i]
+		missing = missing || cols[i] == nil
+	}
+	if missing {
+		s.want.i0, s.want.iN = i0, iN
+	}
+	s.mu.Unlock()
+	if missing {
+		select {
+		case s.wake <- true:
+		default:
+		}
+	}
+	return cols
+}
+
+/* Peak returns the largest level seen so far, for normalising the display */
+func (s *Spectrum) Peak() float32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+/* Level interpolates a column at 'cents' above midi pitch 0 */
+func Level(col []float32, cents float64) float32 {
+	x := (cents / 100.0 - SpectrumLo) * spectrumRes
+	if x < 0 || x >= float64(len(col) - 1) {
+		return 0
+	}
+	i := int(x)
+	α := float32(x - float64(i))
+	return col[i] * (1 - α) + col[i+1] * α
+}
+
+/* Listen returns a channel on which column indices are sent as they are computed */
+func (s *Spectrum) Listen() <-chan int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := make(chan int, 64)
+	s.listeners = append(s.listeners, l)
+	return l
+}
+
+func (s *Spectrum) Ignore(listener <-chan int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, l := range s.listeners {
+		if l == listener {
+			close(l)
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Spectrum) worker() {
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+		for {
+			s.mu.Lock()
+			i := s.want.i0
+			for ; i <= s.want.iN && s.cols[i] != nil; i++ {
+			}
+			done := i > s.want.iN || s.closed
+			s.mu.Unlock()
+			if done {
+				break
+			}
+			col := s.compute(i)
+			s.mu.Lock()
+			s.cols[i] = col
+			for _, v := range col {
+				if v > s.peak {
+					s.peak = v
+				}
+			}
+			for _, l := range s.listeners {
+				select {
+				case l <- i:
+				default: // listener is behind; it'll catch up on the next column
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Spectrum) compute(i int) []float32 {
+	mag := s.wav.magnitudes(FrameN(i) * SpectrumHop, s.win)
+	col := make([]float32, (SpectrumHi - SpectrumLo) * spectrumRes + 1)
+	binHz := float64(s.wav.Rate()) / spectrumWindow
+	for k := range col {
+		b := pitchHz(SpectrumLo + float64(k) / spectrumRes) / binHz
+		if int(b) + 1 >= len(mag) {
+			break
+		}
+		/* linear interpolation between the neighbouring fft bins */
+		j := int(b)
+		α := b - float64(j)
+		col[k] = float32(math.Log1p(mag[j] * (1 - α) + mag[j+1] * α))
+	}
+	return col
+}
@@ -0,0 +1,84 @@
+package wave
+
+import (
+	"math"
+
+	. "github.com/sqweek/sqribe/core/types"
+)
+
+/* period estimates the most prominent beat period of the envelope, in hops, by
+ * autocorrelation. Periods near 'prior' hops are favoured. */
+func (env *Envelope) period(prior float64) float64 {
+	hopsPerSec := float64(env.Rate) / float64(env.Hop)
+	minLag, maxLag := int(0.25 * hopsPerSec), int(2.0 * hopsPerSec) // 240bpm to 30bpm
+	if maxLag >= len(env.Vals) {
+		maxLag = len(env.Vals) - 1
+	}
+	best, bestLag := 0.0, prior
+	for lag := minLag; lag <= maxLag; lag++ {
+		ac := 0.0
+		for i := 0; i + lag < len(env.Vals); i++ {
+			ac += env.Vals[i] * env.Vals[i + lag]
+		}
+		ac /= float64(len(env.Vals) - lag)
+		/* log-gaussian weighting, one octave standard deviation */
+		octaves := math.Log2(float64(lag) / prior)
+		ac *= math.Exp(-0.5 * octaves * octaves)
+		if ac > best {
+			best, bestLag = ac, float64(lag)
+		}
+	}
+	return bestLag
+}
+
+/* TrackBeats finds a sequence of beats which coincide with strong onsets while keeping
+ * a steady tempo, via dynamic programming (see Ellis, "Beat Tracking by Dynamic
+ * Programming", 2007). 'prior' is the expected number of frames per beat, or zero
+ * if unknown. */
+func (env *Envelope) TrackBeats(prior FrameN) []FrameN {
+	if prior <= 0 {
+		prior = FrameN(env.Rate / 2) // 120bpm
+	}
+	n := len(env.Vals)
+	τ := env.period(float64(prior) / float64(env.Hop))
+	if n < 2 || τ < 1 {
+		return nil
+	}
+	const tightness = 680.0 // penalty for deviating from the tempo
+	score := make([]float64, n)
+	back := make([]int, n)
+	for t := 0; t < n; t++ {
+		score[t] = env.Vals[t]
+		back[t] = -1
+		lo, hi := t - int(2 * τ), t - int(τ / 2)
+		if lo < 0 {
+			lo = 0
+		}
+		best := math.Inf(-1)
+		for p := lo; p <= hi; p++ {
+			dev := math.Log(float64(t - p) / τ)
+			if s := score[p] - tightness * dev * dev; s > best {
+				best = s
+				back[t] = p
+			}
+		}
+		if back[t] != -1 {
+			score[t] += best
+		}
+	}
+	/* the final beat is the best scoring point within one period of the end */
+	last := n - 1
+	for t := n - 1; t >= 0 && float64(n - 1 - t) < τ; t-- {
+		if score[t] > score[last] {
+			last = t
+		}
+	}
+	beats := make([]FrameN, 0, int(float64(n) / τ) + 1)
+	for t := last; t != -1; t = back[t] {
+		beats = append(beats, env.Frame(t))
+	}
+	for i, j := 0, len(beats) - 1; i < j; i, j = i + 1, j - 1 {
+		beats[i], beats[j] = beats[j], beats[i]
+	}
+	return beats
+}
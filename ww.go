@@ -5,6 +5,7 @@ import (
 	"math/big"
 	"time"
 	"fmt"
+	"strings"
 
 	"github.com/skelterjohn/go.wde"
 
@@ -44,28 +45,32 @@ func (n *noteProspect) Eq(n2 *noteProspect) bool {
 }
 
 func (p *noteProspect) Δpitch(note *score.Note) int8 {
-	nline, _ := p.staff.LineForPitch(note.Pitch)
+	nline, _ := p.staff.LineForNote(note)
 	if nline == p.delta {
 		return 0
 	}
-	return int8(p.staff.PitchForLine(p.delta) - note.Pitch)
+	return int8(p.staff.PitchForLine(note.Beat, p.delta) - note.Pitch)
 }
 
 /* mkNote returns an existing note on the same staff line, if it exists (duration is ignored).
  * Otherwise a new note is created with the given duration. */
 func (p *noteProspect) mkNote(sc *score.Score, duration *big.Rat) (*score.Note, bool) {
-	beat, offset := sc.Quantize(p.beatf)
+	beat, offset := sc.QuantizeOn(p.staff, p.beatf)
 	f := beat.FrameAtRat(offset)
 	next := sc.Iter(FrameRange{f, f}, p.staff)
+	spelled := sc.Spell(p.staff, FrameRange{Min: f, Max: f})
 	var sn score.StaffNote
 	for next != nil {
 		sn, next = next()
-		if p.Δpitch(sn.Note) == 0 {
+		if sn.Note.Rest {
+			continue
+		}
+		if spelling(spelled, p.staff, sn.Note).Line == p.delta || p.Δpitch(sn.Note) == 0 {
 			return sn.Note, true
 		}
 	}
 	/* no existing note found */
-	return &score.Note{p.staff.PitchForLine(p.delta), duration, beat, offset}, false
+	return &score.Note{Pitch: p.staff.PitchForLine(beat, p.delta), Duration: duration, Beat: beat, Offset: offset}, false
 }
 
 type noteDrag struct {
@@ -88,6 +93,8 @@ type WaveWidget struct {
 	wav *wave.Waveform
 	score *score.Score
 	iolisten <-chan *wave.Chunk
+	spectrum *wave.Spectrum
+	speclisten <-chan int
 
 	/* view related state */
 	first_frame FrameN
@@ -97,6 +104,11 @@ type WaveWidget struct {
 	notesel map[*score.Note]*score.Staff
 	snarf map[*score.Staff] []*score.Note // the cut/copy buffer
 	pasteMode bool
+	suggestion struct {
+		staff *score.Staff
+		notes []*score.Note // ghost notes awaiting acceptance
+	}
+	showSpectrum bool
 	beatdrag map[*score.BeatRef]FrameN
 
 	/* renderer related state */
@@ -167,8 +179,24 @@ func (ww *WaveWidget) SetWaveform(wav *wave.Waveform) *wave.Waveform {
 	if old != nil {
 		old.CacheIgnore(ww.iolisten)
 	}
+	if ww.spectrum != nil {
+		ww.spectrum.Ignore(ww.speclisten)
+		ww.spectrum.Close()
+		ww.spectrum = nil
+	}
 	ww.wav = wav
 	if wav != nil {
+		spectrum := wave.NewSpectrum(wav)
+		speclisten := spectrum.Listen()
+		ww.spectrum, ww.speclisten = spectrum, speclisten
+		go func() {
+			for i := range speclisten {
+				frng := ww.VisibleFrameRange()
+				if ww.showSpectrum && i >= spectrum.ColumnAt(frng.MinFrame()) && i <= spectrum.ColumnAt(frng.MaxFrame()) {
+					ww.changed(WAV, i)
+				}
+			}
+		}()
 		iolisten := wav.CacheListen()
 		ww.iolisten = iolisten
 		go func() {
@@ -193,6 +221,22 @@ func (ww *WaveWidget) SetWaveform(wav *wave.Waveform) *wave.Waveform {
 	return old
 }
 
+func (ww *WaveWidget) ShowSpectrum(show bool) {
+	ww.showSpectrum = show
+	ww.changed(WAV, show)
+}
+
+func (ww *WaveWidget) SpectrumShown() bool {
+	return ww.showSpectrum
+}
+
+/* the spectrum is drawn relative to the synth tuning, so must be redrawn when it changes */
+func (ww *WaveWidget) TuningChanged() {
+	if ww.showSpectrum {
+		ww.changed(WAV, nil)
+	}
+}
+
 func (ww *WaveWidget) SetScore(sc *score.Score) *score.Score {
 	old := ww.score
 	if old != nil {
@@ -208,6 +252,8 @@ func (ww *WaveWidget) SetScore(sc *score.Score) *score.Score {
 				switch ev := ev.(type) {
 				case score.BeatChanged:
 					change |= BEATS
+				case score.MeterChanged:
+					change |= BEATS
 				case score.KeyChanged:
 					change |= MIXER
 				case score.StaffChanged:
@@ -225,6 +271,7 @@ func (ww *WaveWidget) SetScore(sc *score.Score) *score.Score {
 					}
 				case score.ResetStaves:
 					ww.selectNotes(true) // clear selection
+					ww.suggestion.staff, ww.suggestion.notes = nil, nil
 					change |= RESET
 				}
 				// XXX could avoid redraw if the staff/beats aren't visible...
@@ -306,6 +353,279 @@ func (ww *WaveWidget) selectNotes(clear bool, notes... score.StaffNote) {
 	}
 }
 
+/* returns the staff under the mouse, or the first staff if there isn't one */
+func (ww *WaveWidget) StaffAtMouse() *score.Staff {
+	if staff := ww.staffContaining(ww.mouse.pos); staff != nil {
+		return staff
+	}
+	if staves := ww.score.Staves(); len(staves) > 0 {
+		return staves[0]
+	}
+	return nil
+}
+
+/* ShiftKey moves the key of the staff under the mouse (or of every staff, if the mouse
+ * isn't over one) around the circle of fifths by 'dsharps', and through the modes by 'dmode'.
+ * If a range of beats is selected the key changes from the first selected beat onwards,
+ * otherwise the starting key is changed. */
+func (ww *WaveWidget) ShiftKey(dsharps, dmode int) {
+	staves := ww.score.Staves()
+	if staff := ww.staffContaining(ww.mouse.pos); staff != nil {
+		staves = []*score.Staff{staff}
+	}
+	if len(staves) == 0 {
+		return
+	}
+	var beat *score.BeatRef
+	if beats, ok := ww.SelectedTimeRange().(score.BeatRange); ok {
+		beat = beats.First
+	}
+	key, mode := staves[0].KeyAt(beat)
+	key = score.ShiftKey(key, dsharps)
+	mode = (mode + score.Mode(dmode) + score.NModes) % score.NModes
+	ww.score.SetKey(beat, key, mode, staves...)
+}
+
+/* Respell flips the selected notes to their other enharmonic spelling, or those on a
+ * percussion staff to the next drum written on the same line */
+func (ww *WaveWidget) Respell() {
+	var pitched, drums []score.StaffNote
+	for _, sn := range ww.SelectedNotes() {
+		if sn.Staff.Clef().IsPercussion() {
+			drums = append(drums, sn)
+		} else {
+			pitched = append(pitched, sn)
+		}
+	}
+	if len(pitched) > 0 {
+		ww.score.RespellNotes(pitched...)
+	}
+	if len(drums) > 0 {
+		ww.score.CycleDrums(drums...)
+	}
+}
+
+/* CycleClef changes the clef of the staff under the mouse to the one 'dclef' places along
+ * score.Clefs */
+func (ww *WaveWidget) CycleClef(dclef int) {
+	staff := ww.staffContaining(ww.mouse.pos)
+	if staff == nil {
+		return
+	}
+	n := len(score.Clefs)
+	for i, clef := range score.Clefs {
+		if clef == staff.Clef() {
+			ww.score.SetClef(staff, score.Clefs[(i + dclef % n + n) % n])
+			return
+		}
+	}
+	ww.score.SetClef(staff, score.Clefs[0])
+}
+
+/* Transpose changes the transposition of the staff under the mouse by 'Δsemitones'. The
+ * notes keep sounding the same, but are written differently. */
+func (ww *WaveWidget) Transpose(Δsemitones int) {
+	if staff := ww.staffContaining(ww.mouse.pos); staff != nil && !staff.Clef().IsPercussion() {
+		ww.score.SetTransposition(staff, staff.Transposition() + Δsemitones)
+	}
+}
+
+/* CycleGrid changes the quantization grid to the one 'dgrid' places along score.Grids.
+ * With notes selected their staves change grid and the notes move onto it, otherwise the
+ * staff under the mouse changes. */
+func (ww *WaveWidget) CycleGrid(dgrid int) {
+	notes := ww.SelectedNotes()
+	var staves []*score.Staff
+	seen := make(map[*score.Staff]bool)
+	for _, sn := range notes {
+		if !seen[sn.Staff] {
+			seen[sn.Staff] = true
+			staves = append(staves, sn.Staff)
+		}
+	}
+	if len(staves) == 0 {
+		if staff := ww.staffContaining(ww.mouse.pos); staff != nil {
+			staves = append(staves, staff)
+		}
+	}
+	if len(staves) == 0 {
+		return
+	}
+	n := len(score.Grids)
+	next := score.Grids[0]
+	for i, grid := range score.Grids {
+		if grid == staves[0].Grid() {
+			next = score.Grids[(i + dgrid % n + n) % n]
+		}
+	}
+	ww.score.SetGrid(next, staves, notes...)
+}
+
+/* CycleSwing changes the swing of the staff under the mouse to the one 'dswing' places
+ * along score.Swings */
+func (ww *WaveWidget) CycleSwing(dswing int) {
+	staff := ww.staffContaining(ww.mouse.pos)
+	if staff == nil {
+		return
+	}
+	n := len(score.Swings)
+	next := score.Swings[0]
+	for i, swing := range score.Swings {
+		if swing == staff.Swing() {
+			next = score.Swings[(i + dswing % n + n) % n]
+		}
+	}
+	ww.score.SetSwing(staff, next)
+}
+
+/* AdjustVelocity changes the velocity of the selected notes by 'Δvel' */
+func (ww *WaveWidget) AdjustVelocity(Δvel int) {
+	ww.adjustVelocities(ww.SelectedNotes(), Δvel)
+}
+
+/* adjustVelocities changes the velocity of each of 'notes' by 'Δvel', keeping within the
+ * midi range */
+func (ww *WaveWidget) adjustVelocities(notes []score.StaffNote, Δvel int) {
+	velocities := make([]uint8, len(notes))
+	for i, sn := range notes {
+		velocities[i] = clampVelocity(noteVelocity(sn) + Δvel)
+	}
+	ww.score.SetVelocity(velocities, notes...)
+}
+
+/* noteVelocity returns the velocity a note plays at, before any dynamics */
+func noteVelocity(sn score.StaffNote) int {
+	if sn.Note.Velocity != 0 {
+		return int(sn.Note.Velocity)
+	}
+	return Mixer.For(sn.Staff).Velocity
+}
+
+func clampVelocity(vel int) uint8 {
+	if vel > 127 {
+		return 127
+	} else if vel < 1 {
+		return 1
+	}
+	return uint8(vel)
+}
+
+/* dynamicBeat returns the beat a dynamic marking applies to: the start of the selected
+ * beats, or else the beat nearest the mouse */
+func (ww *WaveWidget) dynamicBeat() *score.BeatRef {
+	if beats, ok := ww.SelectedTimeRange().(score.BeatRange); ok {
+		return beats.First
+	}
+	return ww.score.NearestBeat(ww.FrameAtPixel(ww.mouse.pos.X))
+}
+
+/* CycleDynamic changes the dynamic marked on the staff under the mouse to the one 'Δlevel'
+ * louder, cycling back round to no marking */
+func (ww *WaveWidget) CycleDynamic(Δlevel int) {
+	staff := ww.staffContaining(ww.mouse.pos)
+	beat := ww.dynamicBeat()
+	if staff == nil || beat == nil {
+		return
+	}
+	mark := score.DynamicMark{Beat: beat}
+	if dm := staff.DynamicAt(beat); dm != nil {
+		mark = *dm
+	}
+	n := int(score.FF) + 1
+	mark.Level = score.Dynamic(((int(mark.Level) + Δlevel) % n + n) % n)
+	ww.score.SetDynamic(staff, mark)
+}
+
+/* Hairpin marks a crescendo (or for negative 'dir' a diminuendo) across the selected beats
+ * of the staff under the mouse, or removes it if it is already there */
+func (ww *WaveWidget) Hairpin(dir int) {
+	staff := ww.staffContaining(ww.mouse.pos)
+	beats, ok := ww.SelectedTimeRange().(score.BeatRange)
+	if staff == nil || !ok || beats.First == beats.Last {
+		return
+	}
+	mark := score.DynamicMark{Beat: beats.First}
+	if dm := staff.DynamicAt(beats.First); dm != nil {
+		mark = *dm
+	}
+	if mark.Hairpin == dir && mark.End == beats.Last {
+		mark.Hairpin, mark.End = 0, nil
+	} else {
+		mark.Hairpin, mark.End = dir, beats.Last
+	}
+	ww.score.SetDynamic(staff, mark)
+}
+
+/* Suggest displays 'notes' as ghost notes on 'staff', replacing any previous suggestion */
+func (ww *WaveWidget) Suggest(staff *score.Staff, notes []*score.Note) {
+	ww.suggestion.staff, ww.suggestion.notes = staff, notes
+	ww.changed(SCALE, notes)
+}
+
+func (ww *WaveWidget) HasSuggestion() bool {
+	return len(ww.suggestion.notes) > 0
+}
+
+/* AcceptSuggestion adds the suggested notes to the score as a single op */
+func (ww *WaveWidget) AcceptSuggestion() {
+	if ww.HasSuggestion() {
+		ww.score.AddNotes(ww.suggestion.staff, ww.suggestion.notes...)
+	}
+	ww.RejectSuggestion()
+}
+
+func (ww *WaveWidget) RejectSuggestion() {
+	ww.Suggest(nil, nil)
+}
+
+/* CrossStaff moves the selected notes to the staff 'Δstaff' below within their part */
+func (ww *WaveWidget) CrossStaff(Δstaff int) {
+	for _, sn := range ww.score.CrossStaff(Δstaff, ww.SelectedNotes()...) {
+		ww.notesel[sn.Note] = sn.Staff
+	}
+}
+
+/* ToggleJoin groups the staff under the mouse into a part with the staff above it, or
+ * separates it if it is already grouped */
+func (ww *WaveWidget) ToggleJoin() {
+	if staff := ww.staffContaining(ww.mouse.pos); staff != nil {
+		ww.score.JoinStaff(staff, !staff.Joined())
+	}
+}
+
+/* CycleVoice moves the selected notes into the voice after the highest one among them,
+ * wrapping back around to the first */
+func (ww *WaveWidget) CycleVoice() {
+	notes := ww.SelectedNotes()
+	if len(notes) == 0 {
+		return
+	}
+	var voice uint8
+	for _, sn := range notes {
+		if sn.Note.Voice > voice {
+			voice = sn.Note.Voice
+		}
+	}
+	ww.score.SetVoice((voice + 1) % score.NVoices, notes...)
+}
+
+/* PlaceRest adds a rest at the mouse position, lasting as long as the duration last picked
+ * from the note menu */
+func (ww *WaveWidget) PlaceRest() {
+	s := ww.getMouseState(ww.mouse.pos)
+	if s.note == nil || ww.score == nil {
+		return
+	}
+	menu, _ := G.noteMenu.options[G.noteMenu.lastSelected].(string)
+	dur := new(big.Rat)
+	if _, ok := dur.SetString(menu); !ok {
+		return
+	}
+	beat, offset := ww.score.QuantizeOn(s.note.staff, s.note.beatf)
+	rest := &score.Note{Pitch: s.note.staff.PitchForLine(beat, 0), Duration: dur, Beat: beat, Offset: offset, Rest: true}
+	ww.score.AddNotes(s.note.staff, rest)
+}
+
 func (ww *WaveWidget) staffContaining(pos image.Point) *score.Staff {
 	for staff, rect := range ww.rect.staves {
 		if pos.In(rect) {
@@ -443,6 +763,11 @@ func (ww *WaveWidget) beatFrame(beat *score.BeatRef) FrameN {
 func (ww *WaveWidget) ToFrame(pt score.BeatPoint) FrameN {
 	b1 := pt.Beat()
 	f1, f2 := ww.beatFrame(b1), ww.beatFrame(b1.LNext())
+	if b1.Next() == nil && b1.Prev() != nil {
+		/* past the last beat; extrapolate at the tempo of the final beat */
+		f1, f2 = ww.beatFrame(b1.Prev()), f1
+		return f2 + FrameN(pt.Offsetf() * float64(f2 - f1))
+	}
 	return f1 + FrameN(pt.Offsetf() * float64(f2 - f1))
 }
 
@@ -460,15 +785,33 @@ func (ww *WaveWidget) Status() string {
 	delta := 0
 	delta2 := 0
 	offset := big.NewRat(1, 1)
-	nsharps := score.KeySig(-99)
+	key := "???"
+	name := ""
+	grid := ""
 	if s.note != nil {
 		beatf := s.note.beatf
 		delta = s.note.delta
-		_, offset = ww.score.Quantize(beatf)
-		pitch = s.note.staff.PitchForLine(delta)
-		delta2, _ = s.note.staff.LineForPitch(pitch)
-		nsharps = ww.score.Key()
+		var beat *score.BeatRef
+		beat, offset = ww.score.QuantizeOn(s.note.staff, beatf)
+		pitch = s.note.staff.PitchForLine(beat, delta)
+		delta2, _ = s.note.staff.LineForPitch(beat, pitch)
+		nsharps, mode := s.note.staff.KeyAt(beat)
+		key = nsharps.Name(mode)
+		if t := s.note.staff.Transposition(); t != 0 {
+			/* name the instrument by the pitch its written C sounds at */
+			in := strings.TrimRight(midi.PitchName(uint8(midi.PitchC5 + t)), "0123456789")
+			key = fmt.Sprintf("%s, in %s (%+d)", key, in, t)
+		}
+		name = midi.PitchName(pitch)
+		grid = s.note.staff.Grid().Name
+		if swing := s.note.staff.Swing(); swing != 0.5 {
+			grid = fmt.Sprintf("%s, swung %.2f", grid, swing)
+		}
+		if clef := s.note.staff.Clef(); clef.IsPercussion() {
+			drum, _ := score.FindDrum(pitch)
+			name, key = drum.Name, clef.Name
+		}
 	}
 
-	return fmt.Sprintf("line=%d (%d) pitch=%d %s offset=%v %v %v", delta, delta2, pitch, midi.PitchName(pitch), offset, nsharps, len(ww.notesel))
+	return fmt.Sprintf("line=%d (%d) pitch=%d %s offset=%v (%s) %v %v", delta, delta2, pitch, name, offset, grid, key, len(ww.notesel))
 }
@@ -24,6 +24,10 @@ type DisplayNote struct {
 	col color.NRGBA
 	duration float64
 	downBeam bool
+	rest bool
+	cross bool // drawn with an x-head, for cymbals
+	nudge int // pixels from the note head to where the note is played
+	artic score.Articulation
 	pt *image.Point // centre of note head. nil if not visible
 }
 
@@ -140,6 +144,9 @@ func (ww *WaveWidget) Draw(screen wde.Image, r image.Rectangle) {
 	if change != 0 {
 		if change & (LAYOUT | RESET) != 0 {
 			ww.rect.layout(r, ww.score, change & RESET != 0)
+			if ww.showSpectrum {
+				change |= WAV // the spectrum follows the staves
+			}
 		}
 		if ww.renderstate.cursor == nil {
 			curcol := color.RGBA{0, 0xdd, 0, 255}
@@ -157,6 +164,9 @@ func (ww *WaveWidget) Draw(screen wde.Image, r image.Rectangle) {
 		}
 		if change & WAV != 0 {
 			ww.drawWave(ww.renderstate.waveRulers, ww.rect.wave)
+			if ww.showSpectrum {
+				ww.drawSpectrum(ww.renderstate.waveRulers, ww.rect.wave)
+			}
 		}
 		if change & (BEATS | VIEWPOS | SELXN) != 0 {
 			ww.drawBeatAxis(ww.renderstate.waveRulers, ww.rect.beatAxis)
@@ -281,6 +291,59 @@ func (ww *WaveWidget) drawWave(dst draw.Image, r image.Rectangle) {
 	}
 }
 
+/* drawSpectrum overlays each staff with the spectrum of the audio, mapping each pixel
+ * row to the pitch it represents on the staff so that harmonics line up with notes. */
+func (ww *WaveWidget) drawSpectrum(dst *image.RGBA, r image.Rectangle) {
+	sc, spec := ww.score, ww.spectrum
+	if sc == nil || spec == nil {
+		return
+	}
+	tuning := Synth.Tuning()
+	fpp := FrameN(ww.frames_per_pixel)
+	i0 := spec.ColumnAt(ww.FrameAtPixel(r.Min.X))
+	cols := spec.Columns(i0, spec.ColumnAt(ww.FrameAtPixel(r.Max.X)))
+	peak := spec.Peak()
+	if peak <= 0 {
+		return
+	}
+	ink := color.RGBA{0x33, 0x11, 0x66, 0xff}
+	for _, staff := range sc.Staves() {
+		if mix, ok := ww.rect.mixers[staff]; ok && mix.Minimised {
+			continue
+		}
+		rect := ww.rect.staves[staff].Intersect(r)
+		mid := ww.rect.staves[staff].Min.Y + ww.rect.staves[staff].Dy() / 2
+		/* work out the pitch of each row up front; lines are diatonic so interpolate between them */
+		cents := make([]float64, rect.Dy())
+		beat := sc.NearestBeat(ww.first_frame) // the key at the left edge applies
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			δ := float64(mid - y) / (yspacing / 2.0)
+			d0 := int(math.Floor(δ))
+			p0, p1 := float64(staff.PitchForLine(beat, d0)), float64(staff.PitchForLine(beat, d0 + 1))
+			cents[y - rect.Min.Y] = 100 * (p0 + (δ - float64(d0)) * (p1 - p0)) + tuning
+		}
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			f := ww.first_frame + FrameN(x - r.Min.X) * fpp
+			if f < 0 {
+				continue
+			}
+			col := cols[spec.ColumnAt(f) - i0]
+			if col == nil {
+				continue
+			}
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				α := wave.Level(col, cents[y - rect.Min.Y]) / peak
+				α *= α // emphasise the peaks
+				i := dst.PixOffset(x, y)
+				px := dst.Pix[i:i+3]
+				px[0] = uint8(float32(px[0]) * (1 - α) + float32(ink.R) * α)
+				px[1] = uint8(float32(px[1]) * (1 - α) + float32(ink.G) * α)
+				px[2] = uint8(float32(px[2]) * (1 - α) + float32(ink.B) * α)
+			}
+		}
+	}
+}
+
 func (ww *WaveWidget) drawSelxn(dst draw.Image, r image.Rectangle) {
 	csel := color.NRGBA{0xbb, 0xbb, 0xee, 128}
 	rng := ww.SelectedTimeRange()
@@ -318,11 +381,11 @@ func (ww *WaveWidget) drawScale(dst draw.Image, r image.Rectangle, infow int) {
 	lastFrame := ww.VisibleFrameRange().MaxFrame()
 	minX, maxX := -1, -1
 	b0 := ww.score.NearestBeat(ww.first_frame).LPrev()
-	i := b0.BeatNum() - 1
-	for beat := b0; beat != nil; beat = beat.Next() {
+	pos := ww.score.BarPos(b0)
+	sigs := make(map[int]score.TimeSig) // pixel -> time signature starting there
+	for beat := b0; beat != nil; pos, beat = ww.score.NextBarPos(beat, pos), beat.Next() {
 		if beat.Frame() < ww.first_frame {
 			minX = r.Min.X
-			i++
 			continue
 		}
 		if beat.Frame() > lastFrame {
@@ -336,15 +399,25 @@ func (ww *WaveWidget) drawScale(dst draw.Image, r image.Rectangle, infow int) {
 		maxX = x
 		line := image.Rect(x, r.Min.Y, x+1, r.Max.Y)
 		black := black1
-		if i % 4 == 0 {
+		if pos.IsDownbeat() {
 			black = black4
 		}
-		i++
+		if ww.score.TimeSigChangeAt(beat) != nil {
+			sigs[x] = pos.TimeSig
+		}
 		draw.Draw(dst, image.Rect(x-3, r.Min.Y, x+4, r.Min.Y+1), &image.Uniform{black}, r.Min, draw.Over)
 		draw.Draw(dst, image.Rect(x-2, r.Min.Y+1, x+3, r.Min.Y+2), &image.Uniform{black}, r.Min, draw.Over)
 		draw.Draw(dst, image.Rect(x-1, r.Min.Y+2, x+2, r.Min.Y+3), &image.Uniform{black}, r.Min, draw.Over)
 		draw.Draw(dst, line, &image.Uniform{black}, image.ZP, draw.Over)
 	}
+	if head, tail := ww.score.Head, ww.score.Tail; head != tail {
+		/* the tempo is extrapolated beyond the first and last beats, so the staff runs on */
+		black0 := color.RGBA{0x00, 0x00, 0x00, 0x11}
+		for _, x := range ww.extrapolatedBeats(head, tail) {
+			draw.Draw(dst, image.Rect(x, r.Min.Y, x+1, r.Max.Y), &image.Uniform{black0}, image.ZP, draw.Over)
+		}
+		minX, maxX = r.Min.X, r.Max.X
+	}
 	if minX >= maxX || minX == -1 || maxX == -1 {
 		return
 	}
@@ -356,17 +429,122 @@ func (ww *WaveWidget) drawScale(dst draw.Image, r image.Rectangle, infow int) {
 		rect := ww.rect.staves[staff]
 		mid := rect.Min.Y + rect.Dy() / 2
 		drawStaffLines(dst, black4, minX, maxX, mid)
+		for x, ts := range sigs {
+			drawTimeSig(dst, black4, r, x, mid, ts)
+		}
+		ww.drawKeyChanges(dst, r, staff, mid, sigs)
+		ww.drawDynamics(dst, r, staff, mid)
 
 		ww.drawNotes(dst, r, staff, mid, selRect)
+		ww.drawSuggestion(dst, r, staff, mid)
 
 		ww.drawProspectiveNote(dst, r, staff, mid)
 	}
+	/* staves grouped into a part are braced together at the start of the system */
+	for _, part := range ww.score.Parts() {
+		top, bottom := -1, -1
+		for _, staff := range part {
+			if mix, ok := ww.rect.mixers[staff]; ok && mix.Minimised {
+				continue
+			}
+			rect := ww.rect.staves[staff]
+			mid := rect.Min.Y + rect.Dy() / 2
+			if top == -1 {
+				top = mid - 2 * yspacing
+			}
+			bottom = mid + 2 * yspacing
+		}
+		if len(part) < 2 || top == -1 || top == bottom - 4 * yspacing {
+			continue
+		}
+		draw.Draw(dst, image.Rect(minX, top, minX + 1, bottom + 1), &image.Uniform{black4}, image.ZP, draw.Over)
+		x := minX - 2
+		if x - yspacing < r.Min.X {
+			x = minX + yspacing + 2
+		}
+		draw.Draw(dst, r, &BraceGlyph{color.NRGBA{0, 0, 0, 0x88}, x, top, bottom, yspacing}, r.Min, draw.Over)
+	}
 	if selRect != nil {
 		drawBorders(dst, *selRect, color.NRGBA{0xff,0xff,0xff,0x88}, color.NRGBA{0xff,0xff,0xff,0x44})
 		// TODO highlight notes within selection rect
 	}
 }
 
+/* draws the staff's key changes just before their bar lines, to the left of any time signature */
+func (ww *WaveWidget) drawKeyChanges(dst draw.Image, r image.Rectangle, staff *score.Staff, mid int, sigs map[int]score.TimeSig) {
+	col := color.NRGBA{0x00, 0x00, 0x00, 0x88}
+	rng := ww.VisibleFrameRange()
+	for _, kc := range staff.KeySigChanges() {
+		if kc.Beat.Frame() < rng.MinFrame() || kc.Beat.Frame() > rng.MaxFrame() {
+			continue
+		}
+		x := ww.PixelAtFrame(ww.beatFrame(kc.Beat))
+		key, lines := staff.KeyAccidentalLines(kc.Beat) // as written, on a transposing staff
+		if key.Count() == 0 {
+			_, lines = staff.KeyAccidentalLines(kc.Beat.Prev()) // cancel the old accidentals
+		}
+		if _, ok := sigs[x]; ok {
+			x -= yspacing
+		}
+		x -= yspacing / 2 + keySigWidth(len(lines))
+		drawKeySig(dst, col, r, x, mid, key, lines)
+	}
+}
+
+/* draws the staff's dynamics and hairpins below it */
+func (ww *WaveWidget) drawDynamics(dst draw.Image, r image.Rectangle, staff *score.Staff, mid int) {
+	col := color.NRGBA{0x00, 0x00, 0x00, 0x88}
+	rng := ww.VisibleFrameRange()
+	y := mid + yspacing * 3
+	for _, dm := range staff.Dynamics() {
+		end := dm.Beat
+		if dm.Hairpin != 0 && dm.End != nil {
+			end = dm.End
+		}
+		if end.Frame() < rng.MinFrame() || dm.Beat.Frame() > rng.MaxFrame() {
+			continue
+		}
+		x := ww.PixelAtFrame(ww.beatFrame(dm.Beat))
+		x0 := x
+		if dm.Level != score.NoDynamic {
+			G.font.luxi.DrawC(dst, col, r, dm.Level.String(), image.Pt(x, y))
+			x0 += yspacing
+		}
+		if end != dm.Beat {
+			x1 := ww.PixelAtFrame(ww.beatFrame(end)) - yspacing
+			draw.Draw(dst, r, &HairpinGlyph{col, x0, x1, y, yspacing, dm.Hairpin > 0}, r.Min, draw.Over)
+		}
+	}
+}
+
+/* returns the pixel positions of the visible beats extrapolated before 'head' and after 'tail' */
+func (ww *WaveWidget) extrapolatedBeats(head, tail *score.BeatRef) []int {
+	xs := make([]int, 0)
+	first, last := ww.first_frame, ww.VisibleFrameRange().MaxFrame()
+	h0, h1 := ww.beatFrame(head), ww.beatFrame(head.Next())
+	t0, t1 := ww.beatFrame(tail.Prev()), ww.beatFrame(tail)
+	if (h1 - h0) / FrameN(ww.frames_per_pixel) < 4 || (t1 - t0) / FrameN(ww.frames_per_pixel) < 4 {
+		return xs // too dense to be useful
+	}
+	for f := h0 - (h1 - h0); f >= first; f -= h1 - h0 {
+		if f > last {
+			f -= (f - last + h1 - h0 - 1) / (h1 - h0) * (h1 - h0) // skip ahead to the visible range
+		}
+		if f >= first {
+			xs = append(xs, ww.PixelAtFrame(f))
+		}
+	}
+	for f := t1 + (t1 - t0); f <= last; f += t1 - t0 {
+		if f < first {
+			f += (first - f + t1 - t0 - 1) / (t1 - t0) * (t1 - t0)
+		}
+		if f <= last {
+			xs = append(xs, ww.PixelAtFrame(f))
+		}
+	}
+	return xs
+}
+
 func drawStaffLines(dst draw.Image, col color.Color, minX, maxX, mid int) {
 	minY, maxY := mid - 2 * yspacing, mid + 2 * yspacing
 	for y := minY; y <= maxY; y += yspacing {
@@ -375,6 +553,32 @@ func drawStaffLines(dst draw.Image, col color.Color, minX, maxX, mid int) {
 	}
 }
 
+func drawTimeSig(dst draw.Image, col color.Color, r image.Rectangle, x, mid int, ts score.TimeSig) {
+	x -= yspacing // sit just before the bar line so we don't collide with the first note
+	G.font.luxi.DrawC(dst, col, r, fmt.Sprint(ts.Beats), image.Pt(x, mid - yspacing))
+	G.font.luxi.DrawC(dst, col, r, fmt.Sprint(ts.Unit), image.Pt(x, mid + yspacing))
+}
+
+/* draws the accidentals of a key signature starting from x. A key without any accidentals
+ * is drawn as naturals on 'lines', which should be those of the key it replaces. */
+func drawKeySig(dst draw.Image, col color.NRGBA, r image.Rectangle, x, mid int, keysig score.KeySig, lines []int) {
+	ax := 0
+	if keysig.IsSharps() {
+		ax = 1
+	} else if keysig.Count() > 0 {
+		ax = -1
+	}
+	for i, delta := range lines {
+		p := image.Point{x + (i + 1) * (yspacing/2), mid - delta * yspacing/2}
+		draw.Draw(dst, r, newAccidental(col, p, yspacing/2, ax), r.Min, draw.Over)
+	}
+}
+
+/* returns the width drawKeySig needs for 'n' accidentals */
+func keySigWidth(n int) int {
+	return (n + 1) * (yspacing/2)
+}
+
 func drawBorders(dst draw.Image, r image.Rectangle, border color.Color, fill color.Color) {
 	top := image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y + 1)
 	left := image.Rect(r.Min.X, r.Min.Y, r.Min.X + 1, r.Max.Y)
@@ -404,7 +608,7 @@ func (ww *WaveWidget) drawStaffCtl(dst draw.Image, staff *score.Staff) {
 		G.font.luxi.DrawC(dst, fg, layout.minmaxB, "-", centerPt(layout.minmaxB))
 	}
 	drawBorders(dst, layout.instC, border, white)
-	instName := midi.InstName(mix.Voice)
+	instName := midi.InstName(Mixer.Inst(staff))
 	G.font.luxi.DrawC(dst, black, layout.instC, instName, centerPt(layout.instC))
 
 	var fill color.NRGBA
@@ -420,36 +624,58 @@ func (ww *WaveWidget) drawStaffCtl(dst draw.Image, staff *score.Staff) {
 
 	mid := r.Min.Y + r.Dy() / 2
 	drawStaffLines(dst, fg, layout.sig.Min.X, layout.sig.Max.X, mid)
-	keysig, lines := staff.KeyAccidentalLines()
-	for i, delta := range lines {
-		cg := CenteredGlyph{
-			col: fg,
-			p: image.Point{layout.sig.Min.X + (i + 1) * (yspacing/2), mid - delta * yspacing/2},
-			r: yspacing/2,
-		}
-		var glyph image.Image
-		if keysig.IsSharps() {
-			glyph = &SharpGlyph{cg}
-		} else {
-			glyph = &FlatGlyph{cg}
-		}
-		draw.Draw(dst, r, glyph, r.Min, draw.Over)
+	/* show the key in effect at the left edge of the view */
+	var beat *score.BeatRef
+	if ww.score.HasBeats() {
+		beat = ww.score.NearestBeat(ww.first_frame)
 	}
+	keysig, lines := staff.KeyAccidentalLines(beat)
+	drawKeySig(dst, fg, r, layout.sig.Min.X, mid, keysig, lines)
 
 //	restR := image.Rectangle{r.Min, image.Point{sigR.Min.X, r.Max.Y}}.Inset(1)
 //	drawBorders(dst, restR, border, bg)
 	drawVertSlider(dst, layout.volS, fg, float64(mix.Velocity) / 127.0)
 }
 
-func (ww *WaveWidget) dispNote(staff *score.Staff, note *score.Note, mid int) *DisplayNote {
+/* spelling looks up how a note is written, falling back to spelling it in isolation for
+ * notes which aren't in 'spelled' (eg. notes being dragged or pasted) */
+func spelling(spelled map[*score.Note]score.Spelled, staff *score.Staff, note *score.Note) score.Spelled {
+	if sp, ok := spelled[note]; ok {
+		return sp
+	}
+	return staff.SpellNote(note)
+}
+
+func (ww *WaveWidget) dispNote(staff *score.Staff, note *score.Note, sp score.Spelled, mid int) *DisplayNote {
 	dn := DisplayNote{}
 	dn.duration = note.Durf()
-	dn.delta, dn.accidental = staff.LineForPitch(note.Pitch)
+	dn.delta = sp.Line
+	if note.Rest {
+		dn.rest, dn.delta = true, 0 // rests sit in the middle of the staff
+	} else if sp.Show {
+		dn.accidental = &sp.Accidental
+	}
+	dn.artic = note.Articulations
+	if drum, ok := score.FindDrum(note.Pitch); ok && staff.Clef().IsPercussion() {
+		dn.cross = drum.Cross
+	}
 	dn.downBeam = (dn.delta > 2)
+	if staff.Voices() > 1 {
+		/* with several voices, stems (and rests) go up or down according to the voice */
+		dn.downBeam = (note.Voice % 2 == 1)
+		if note.Rest && dn.downBeam {
+			dn.delta = -2
+		} else if note.Rest {
+			dn.delta = 2
+		}
+	}
 	rng:= ww.VisibleFrameRange()
 	frame := ww.ToFrame(ww.score.Beatf(note))
 	if frame >= rng.MinFrame() && frame <= rng.MaxFrame() {
 		dn.pt = &image.Point{ww.PixelAtFrame(frame), mid - (yspacing / 2) * dn.delta}
+		if note.Nudge != 0 {
+			dn.nudge = ww.PixelAtFrame(frame + note.Nudge) - dn.pt.X
+		}
 	}
 	return &dn
 }
@@ -458,6 +684,11 @@ func (ww *WaveWidget) drawNote(dst draw.Image, r image.Rectangle, mid int, n *Di
 	if n.pt == nil {
 		return
 	}
+	if n.rest {
+		ww.drawRest(dst, r, n)
+		ww.drawDots(dst, r, n)
+		return
+	}
 	black := color.NRGBA{0, 0, 0, n.col.A}
 
 	/* ledger lines */
@@ -472,8 +703,22 @@ func (ww *WaveWidget) drawNote(dst draw.Image, r image.Rectangle, mid int, n *Di
 		draw.Draw(dst, line, &image.Uniform{black}, image.ZP, draw.Over)
 	}
 
-	var head *NoteHead
-	if n.duration < 2 {
+	/* a faint line out to where the note is played, if it's nudged off the beat */
+	if n.nudge != 0 {
+		faint := color.NRGBA{n.col.R, n.col.G, n.col.B, n.col.A / 3}
+		x0, x1 := n.pt.X, n.pt.X + n.nudge
+		if x1 < x0 {
+			x0, x1 = x1, x0
+		}
+		draw.Draw(dst, image.Rect(x0, n.pt.Y, x1 + 1, n.pt.Y + 1), &image.Uniform{faint}, image.ZP, draw.Over)
+		x := n.pt.X + n.nudge
+		draw.Draw(dst, image.Rect(x, n.pt.Y - 2, x + 1, n.pt.Y + 3), &image.Uniform{faint}, image.ZP, draw.Over)
+	}
+
+	var head image.Image
+	if n.cross {
+		head = newXHead(n.col, *n.pt, yspacing/2 - 1, n.duration >= 2)
+	} else if n.duration < 2 {
 		head = newNoteHead(n.col, *n.pt, yspacing/2, 35.0)
 	} else {
 		head = newHollowNote(n.col, *n.pt, yspacing/2, 35.0)
@@ -502,6 +747,14 @@ func (ww *WaveWidget) drawNote(dst draw.Image, r image.Rectangle, mid int, n *Di
 			draw.Draw(dst, r, &NoteTail{CenteredGlyph{n.col, c, 4*yspacing/(2*5)}, n.downBeam}, r.Min, draw.Over)
 		}
 	}
+	ww.drawDots(dst, r, n)
+	ww.drawArticulations(dst, r, mid, n)
+	if n.accidental != nil {
+		draw.Draw(dst, r, newAccidental(n.col, n.pt.Sub(image.Pt(yspacing, 0)), yspacing/2, *n.accidental), r.Min, draw.Over)
+	}
+}
+
+func (ww *WaveWidget) drawDots(dst draw.Image, r image.Rectangle, n *DisplayNote) {
 	/* TODO triplets */
 	dotted := 0
 	for d := 2.0; d >= 1./128; d/=2 {
@@ -516,22 +769,81 @@ func (ww *WaveWidget) drawNote(dst draw.Image, r image.Rectangle, mid int, n *Di
 	for i := 0; i < dotted; i++ {
 		draw.Draw(dst, r, &DotGlyph{CenteredGlyph{n.col, n.pt.Add(image.Pt(yspacing/2 + 3 + 5*i, 0)), yspacing/2}}, r.Min, draw.Over)
 	}
-	if n.accidental != nil {
-		draw.Draw(dst, r, newAccidental(n.col, n.pt.Sub(image.Pt(yspacing, 0)), yspacing/2, *n.accidental), r.Min, draw.Over)
+}
+
+/* drawRest draws a block for whole and half rests, otherwise a crotchet rest with a
+ * flag for each halving */
+func (ww *WaveWidget) drawRest(dst draw.Image, r image.Rectangle, n *DisplayNote) {
+	x, mid := n.pt.X, n.pt.Y
+	switch {
+	case n.duration >= 4:
+		block := image.Rect(x - yspacing/2, mid - yspacing, x + yspacing/2 + 1, mid - yspacing/2)
+		draw.Draw(dst, block.Intersect(r), &image.Uniform{n.col}, image.ZP, draw.Over)
+	case n.duration >= 2:
+		block := image.Rect(x - yspacing/2, mid - yspacing/2, x + yspacing/2 + 1, mid)
+		draw.Draw(dst, block.Intersect(r), &image.Uniform{n.col}, image.ZP, draw.Over)
+	default:
+		flags := 0
+		for d := 0.5; d >= n.duration - 1e-6; d /= 2 {
+			flags++
+		}
+		draw.Draw(dst, r, &RestGlyph{CenteredGlyph{n.col, *n.pt, yspacing * 3 / 2}, flags}, r.Min, draw.Over)
+	}
+}
+
+/* drawTie draws the tie from note 'n' to the note at x1 (which may be off-screen) */
+func (ww *WaveWidget) drawTie(dst draw.Image, r image.Rectangle, n *DisplayNote, x0, x1 int) {
+	y := n.pt.Y + yspacing/2 + 1
+	if n.downBeam {
+		y = n.pt.Y - yspacing/2 - 1
 	}
+	tie := &TieGlyph{n.col, image.Pt(x0, y), x1, n.downBeam}
+	draw.Draw(dst, r, tie, r.Min, draw.Over)
 }
 
 
+/* draws a note's articulations on the side of the head away from the stem, except for a
+ * fermata which always goes above the staff */
+func (ww *WaveWidget) drawArticulations(dst draw.Image, r image.Rectangle, mid int, n *DisplayNote) {
+	dy := yspacing
+	if !n.downBeam {
+		dy = -yspacing
+	}
+	y := n.pt.Y - dy
+	for _, a := range score.Articulations {
+		if !n.artic.Has(a) {
+			continue
+		}
+		p := image.Pt(n.pt.X, y)
+		if a == score.Fermata {
+			top := mid - 2 * yspacing
+			if n.pt.Y < top {
+				top = n.pt.Y
+			}
+			p.Y = top - yspacing * 3 / 2
+		} else {
+			y -= dy
+		}
+		draw.Draw(dst, r, &ArticGlyph{CenteredGlyph{n.col, p, yspacing / 2}, a}, r.Min, draw.Over)
+	}
+}
+
 func (ww *WaveWidget) drawNotes(dst draw.Image, r image.Rectangle, staff *score.Staff, mid int, selRect *image.Rectangle) {
 	next := score.Chords(ww.score.Iter(ww.VisibleFrameRange(), staff))
+	spelled := ww.score.Spell(staff, ww.VisibleFrameRange())
 	var chord []score.StaffNote
 	for next != nil {
 		chord, next = next()
 		downBeam := true
 		notes := make([]*DisplayNote, len(chord))
 		for i, sn := range chord {
-			notes[i] = ww.dispNote(staff, sn.Note, mid)
-			downBeam = downBeam && (notes[i].delta > 2)
+			notes[i] = ww.dispNote(staff, sn.Note, spelling(spelled, staff, sn.Note), mid)
+			if !notes[i].rest {
+				downBeam = downBeam && (notes[i].delta > 2)
+			}
+		}
+		if staff.Voices() > 1 {
+			downBeam = notes[0].downBeam // decided by the chord's voice
 		}
 		for i, note := range notes {
 			_, selected := ww.notesel[chord[i].Note]
@@ -549,10 +861,38 @@ func (ww *WaveWidget) drawNotes(dst draw.Image, r image.Rectangle, staff *score.
 			}
 			note.downBeam = downBeam
 			ww.drawNote(dst, r, mid, note)
+			if note.pt == nil {
+				continue
+			}
+			/* ties run from just right of this note to just left of the next */
+			rng := ww.VisibleFrameRange()
+			if to := staff.TiedTo(chord[i].Note); to != nil {
+				x1 := r.Max.X
+				if f := ww.ToFrame(ww.score.Beatf(to)); f <= rng.MaxFrame() {
+					x1 = ww.PixelAtFrame(f) - yspacing/2 - 1
+				}
+				ww.drawTie(dst, r, note, note.pt.X + yspacing/2 + 1, x1)
+			}
+			if from := staff.TiedFrom(chord[i].Note); from != nil {
+				if f := ww.ToFrame(ww.score.Beatf(from)); f < rng.MinFrame() {
+					ww.drawTie(dst, r, note, r.Min.X, note.pt.X - yspacing/2 - 1)
+				}
+			}
 		}
 	}
 }
 
+func (ww *WaveWidget) drawSuggestion(dst draw.Image, r image.Rectangle, staff *score.Staff, mid int) {
+	if ww.suggestion.staff != staff {
+		return
+	}
+	for _, note := range ww.suggestion.notes {
+		dn := ww.dispNote(staff, note, spelling(nil, staff, note), mid)
+		dn.col = color.NRGBA{0x22, 0x88, 0x22, 0x88}
+		ww.drawNote(dst, r, mid, dn)
+	}
+}
+
 func (ww *WaveWidget) drawProspectiveNote(dst draw.Image, r image.Rectangle, staff *score.Staff, mid int) {
 	s := ww.getMouseState(ww.mouse.pos)
 	if s.rectSelect != nil {
@@ -564,7 +904,7 @@ func (ww *WaveWidget) drawProspectiveNote(dst draw.Image, r image.Rectangle, sta
 				continue
 			}
 			note := sn.Note.Dup().Mv(s.ndelta.Δpitch, s.ndelta.Δbeat)
-			n := ww.dispNote(sn.Staff, note, mid)
+			n := ww.dispNote(sn.Staff, note, spelling(nil, staff, note), mid)
 			n.col = color.NRGBA{0x88, 0x88, 0x88, 0xaa}
 			ww.drawNote(dst, r, mid, n)
 		}
@@ -572,10 +912,11 @@ func (ww *WaveWidget) drawProspectiveNote(dst draw.Image, r image.Rectangle, sta
 		sc := ww.score
 		anchor := ww.snarf[s.note.staff][0]
 		Δpitch := s.note.Δpitch(anchor)
-		beat, offset := sc.Quantize(s.note.beatf)
+		beat, offset := sc.QuantizeOn(s.note.staff, s.note.beatf)
 		Δbeat := Δb(beat, offset, anchor.Beat, anchor.Offset)
 		for _, note := range ww.snarf[staff] {
-			n := ww.dispNote(staff, note.Dup().Mv(Δpitch, Δbeat), mid)
+			dup := note.Dup().Mv(Δpitch, Δbeat)
+			n := ww.dispNote(staff, dup, spelling(nil, staff, dup), mid)
 			n.col = color.NRGBA{0x88, 0x88, 0x88, 0xaa}
 			ww.drawNote(dst, r, mid, n)
 		}
@@ -584,7 +925,13 @@ func (ww *WaveWidget) drawProspectiveNote(dst draw.Image, r image.Rectangle, sta
 		var dur big.Rat
 		dur.SetString(menu)
 		note, exists := s.note.mkNote(ww.score, &dur)
-		dn := ww.dispNote(staff, note, mid)
+		var sp score.Spelled
+		if exists {
+			sp = spelling(ww.score.Spell(staff, ww.VisibleFrameRange()), staff, note)
+		} else {
+			sp = staff.SpellNote(note)
+		}
+		dn := ww.dispNote(staff, note, sp, mid)
 		if !exists {
 			dn.col = colourFor(note.Offset, 0xbb)
 		} else {
@@ -644,21 +991,23 @@ func (ww *WaveWidget) drawTicks(dst draw.Image, r image.Rectangle, bottom bool,
 }
 
 func (ww *WaveWidget) drawBeatAxis(dst draw.Image, r image.Rectangle) {
-	score := ww.score
-	label := func(beatf float64) string {
-		return fmt.Sprintf("b%d", int(beatf))
+	sc := ww.score
+	positions := make([]score.BarPos, 0)
+	label := func(i float64) string {
+		return positions[int(i)].String()
 	}
 	beats := make([]float64, 0)
 	frames := make([]FrameN, 0)
-	if score != nil && score.HasBeats() {
-		b0 := score.NearestBeat(ww.FrameAtPixel(r.Min.X)).LPrev()
+	if sc != nil && sc.HasBeats() {
+		b0 := sc.NearestBeat(ww.FrameAtPixel(r.Min.X)).LPrev()
 		// XXX should start search from b0
-		bN := score.NearestBeat(ww.FrameAtPixel(r.Max.X)).LNext()
-		i := b0.BeatNum()
+		bN := sc.NearestBeat(ww.FrameAtPixel(r.Max.X)).LNext()
+		pos := sc.BarPos(b0)
 		for b := b0; b != nil && ww.beatFrame(b) <= ww.beatFrame(bN); b = b.Next() {
-			beats = append(beats, float64(i))
+			beats = append(beats, float64(len(positions)))
 			frames = append(frames, ww.beatFrame(b))
-			i++
+			positions = append(positions, pos)
+			pos = sc.NextBarPos(b, pos)
 		}
 	}
 	ww.drawTicks(dst, r, true, beats, frames, label)
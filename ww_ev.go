@@ -29,7 +29,13 @@ func (ww *WaveWidget) MouseMoved(mousePos image.Point) wde.Cursor {
 
 func (ww *WaveWidget) LeftClick(mouse image.Point) {
 	if mouse.In(ww.rect.newStaffB) && ww.score != nil {
-		ww.score.AddStaff(score.MkStaff("", &score.TrebleClef, ww.score.Key()))
+		ww.score.AddStaff(score.MkStaff("", &score.TrebleClef, ww.score.Key(), ww.score.Mode()))
+		if G.kb.shift {
+			/* grand staff */
+			bass := score.MkStaff("", &score.BassClef, ww.score.Key(), ww.score.Mode())
+			ww.score.AddStaff(bass)
+			ww.score.JoinStaff(bass, true)
+		}
 		return
 	}
 	for staff, layout := range ww.rect.mixers {
@@ -47,7 +53,7 @@ func (ww *WaveWidget) LeftClick(mouse image.Point) {
 
 func (ww *WaveWidget) RightClick(mouse image.Point) {
 	if mouse.In(ww.rect.newStaffB) && ww.score != nil {
-		ww.score.AddStaff(score.MkStaff("", &score.BassClef, ww.score.Key()))
+		ww.score.AddStaff(score.MkStaff("", &score.BassClef, ww.score.Key(), ww.score.Mode()))
 		return
 	}
 	if mouse.In(ww.rect.mixer) {
@@ -73,7 +79,7 @@ func (ww *WaveWidget) RightClick(mouse image.Point) {
 		if s := ww.getMouseState(mouse); s != nil && len(ww.snarf[s.note.staff]) > 0 {
 			anchor := ww.snarf[s.note.staff][0]
 			Δpitch := s.note.Δpitch(anchor)
-			beat, offset := sc.Quantize(s.note.beatf)
+			beat, offset := sc.QuantizeOn(s.note.staff, s.note.beatf)
 			Δbeat := Δb(beat, offset, anchor.Beat, anchor.Offset)
 			for staff, notes := range ww.snarf {
 				mv := make([]*score.Note, 0, len(notes))
@@ -99,6 +105,9 @@ func (ww *WaveWidget) ButtonDown(e wde.MouseDownEvent) DragFn {
 		case wde.MiddleButton:
 			return ww.scrollDrag(e.Where)
 		case wde.RightButton:
+			if e.Where.In(ww.rect.beatAxis) {
+				return ww.timeSigDrag(e.Where)
+			}
 			return ww.placeNoteDrag(e.Where)
 		case wde.LeftButton:
 			return ww.getMouseState(e.Where).dragFn
@@ -160,6 +169,23 @@ func (ww *WaveWidget) placeNoteDrag(mouse image.Point) DragFn {
 	return G.noteMenu.Drag
 }
 
+func (ww *WaveWidget) timeSigDrag(mouse image.Point) DragFn {
+	sc := ww.score
+	if sc == nil || !sc.HasBeats() {
+		return nil
+	}
+	beat := sc.NearestBeat(ww.FrameAtPixel(mouse.X))
+	G.meterMenu.SetDefault(sc.TimeSigAt(beat))
+	reply := G.meterMenu.Popup(ww.Rect(), ww.refresh, mouse)
+	go func() {
+		item := <-reply
+		if ts, ok := item.(score.TimeSig); item != nil && ok {
+			sc.SetTimeSig(beat, ts)
+		}
+	}()
+	return G.meterMenu.Drag
+}
+
 func (ww *WaveWidget) scrollDrag(mouse image.Point) DragFn {
 	prevX := mouse.X
 	return func(pos image.Point, finished bool, moved bool)bool {
@@ -230,7 +256,7 @@ func (ww *WaveWidget) noteDrag(staff *score.Staff, note *score.Note) DragFn {
 			return false
 		}
 		Δpitch := prospect.Δpitch(note)
-		beat, offset := sc.Quantize(prospect.beatf)
+		beat, offset := sc.QuantizeOn(staff, prospect.beatf)
 		Δbeat := Δb(beat, offset, note.Beat, note.Offset)
 		_, selected := ww.notesel[note]
 		if finished {
@@ -258,6 +284,24 @@ func (ww *WaveWidget) noteDrag(staff *score.Staff, note *score.Note) DragFn {
 	}
 }
 
+/* velocityDrag changes the velocity of 'note', or of the selection if it includes 'note',
+ * by dragging up (louder) or down */
+func (ww *WaveWidget) velocityDrag(staff *score.Staff, note *score.Note) DragFn {
+	start := ww.mouse.pos
+	return func(pos image.Point, finished bool, moved bool)bool {
+		if !finished || !moved {
+			return true
+		}
+		Δvel := start.Y - pos.Y
+		notes := []score.StaffNote{{staff, note}}
+		if _, selected := ww.notesel[note]; selected {
+			notes = ww.SelectedNotes()
+		}
+		ww.adjustVelocities(notes, Δvel)
+		return true
+	}
+}
+
 func (ww *WaveWidget) noteSelectDrag(start image.Point) DragFn {
 	// XXX funny interaction with scrolling because we hold on to pixel values
 	sc := ww.score
@@ -269,11 +313,16 @@ func (ww *WaveWidget) noteSelectDrag(start image.Point) DragFn {
 			ww.changed(SCALE, r)
 		} else {
 			notes := make([]score.StaffNote, 0, 8)
+			spelled := make(map[*score.Staff]map[*score.Note]score.Spelled)
 			var sn score.StaffNote
 			next := sc.Iter(ww.VisibleFrameRange())
 			for next != nil {
 				sn, next = next()
-				dn := ww.dispNote(sn.Staff, sn.Note, centerPt(ww.rect.staves[sn.Staff]).Y)
+				if spelled[sn.Staff] == nil {
+					spelled[sn.Staff] = sc.Spell(sn.Staff, ww.VisibleFrameRange())
+				}
+				sp := spelling(spelled[sn.Staff], sn.Staff, sn.Note)
+				dn := ww.dispNote(sn.Staff, sn.Note, sp, centerPt(ww.rect.staves[sn.Staff]).Y)
 				if dn.pt != nil && dn.pt.In(r) {
 					notes = append(notes, sn)
 				}
@@ -309,16 +358,19 @@ func (ww *WaveWidget) dragState(mouse image.Point) (DragFn, wde.Cursor) {
 		}
 		mid := rect.Min.Y + rect.Dy() / 2
 		next := sc.Iter(rng, staff)
+		spelled := sc.Spell(staff, rng)
 		var sn score.StaffNote
 		for next != nil {
 			sn, next = next()
 			frame, _ := sc.ToFrame(sc.Beatf(sn.Note))
 			x := ww.PixelAtFrame(frame)
-			delta, _ := staff.LineForPitch(sn.Note.Pitch)
+			delta := spelling(spelled, staff, sn.Note).Line
 			y := mid - (yspacing / 2) * (delta)
 			r := padPt(image.Pt(x, y), yspacing / 2, yspacing / 2)
 			// XXX would be good to target the closest note instead of the first
-			if mouse.In(r) {
+			if mouse.In(r) && G.kb.ctrl {
+				return ww.velocityDrag(staff, sn.Note), wde.GrabHoverCursor
+			} else if mouse.In(r) {
 				return ww.noteDrag(staff, sn.Note), wde.GrabHoverCursor
 			}
 		}